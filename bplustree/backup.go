@@ -0,0 +1,155 @@
+package bplustree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ------------------------------------------------
+// a backup is a compacted copy of a snapshot:
+//  master page | tree pages in post-order, one tree after another
+// ------------------------------------------------
+// the pages reachable from the snapshot are renumbered in the order they
+// are written, so the copy has no free list and no unused pages.
+// children are written before their parents, overflow pages before
+// their leaves, so pointers are known when a page is written.
+
+type backup struct {
+	rx   *ReadTx
+	w    io.Writer
+	next uint64 // the new number of the next page
+}
+
+// write a consistent copy of the committed version as a database file.
+// writers are not blocked while it's copied, see ReadTx.Backup().
+func (db *Pager) Backup(w io.Writer) error {
+	rx := db.BeginRead()
+	defer rx.Done()
+	return rx.Backup(w)
+}
+
+// write the snapshot as a database file. the pages of a snapshot are
+// not reused until it's done, so they are copied as they are.
+func (rx *ReadTx) Backup(w io.Writer) (err error) {
+	assert(!rx.done)
+	// bad pages panic in the reader
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*PageError)
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("backup: %w", perr)
+		}
+	}()
+
+	names := make([]string, 0, len(rx.roots))
+	for name := range rx.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the new roots are the last pages of each tree
+	b := &backup{rx: rx, w: w, next: 1}
+	pageSize := rx.db.PageSize
+	m := master{used: 1, checksum: true, pageSize: pageSize, roots: map[string]uint64{}}
+	if rx.tree.Root != 0 {
+		m.used += b.count(rx.tree.Root)
+		m.root = m.used - 1
+	}
+	for _, name := range names {
+		m.used += b.count(rx.roots[name])
+		m.roots[name] = m.used - 1
+	}
+
+	page := make([]byte, pageSize)
+	copy(page, masterEncode(m))
+	if _, err := w.Write(page); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if rx.tree.Root != 0 {
+		if _, err := b.copyNode(rx.tree.Root); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if _, err := b.copyNode(rx.roots[name]); err != nil {
+			return err
+		}
+	}
+	assert(b.next == m.used)
+	return nil
+}
+
+// the number of pages in a subtree
+func (b *backup) count(ptr uint64) uint64 {
+	node := b.rx.tree.get(ptr)
+	total := uint64(1)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			total += b.count(node.getPtr(i))
+		} else if node.valOverflow(i) {
+			size, _ := overflowRef(node.GetVal(i))
+			total += b.rx.tree.size.overflowPages(size)
+		}
+	}
+	return total
+}
+
+// copy a subtree, returns the new pointer to it.
+func (b *backup) copyNode(ptr uint64) (uint64, error) {
+	node := b.rx.tree.get(ptr)
+	out := BNode{make([]byte, b.rx.db.PageSize)}
+	copy(out.Data, node.Data)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			child, err := b.copyNode(node.getPtr(i))
+			if err != nil {
+				return 0, err
+			}
+			out.setPtr(i, child)
+		} else if node.valOverflow(i) {
+			first, err := b.copyOverflow(node.GetVal(i))
+			if err != nil {
+				return 0, err
+			}
+			binary.LittleEndian.PutUint64(out.GetVal(i)[8:], first)
+		}
+	}
+	return b.write(out.Data)
+}
+
+// copy the overflow pages of a large value, returns the new first page.
+func (b *backup) copyOverflow(ref []byte) (uint64, error) {
+	size, ptr := overflowRef(ref)
+	first := b.next
+	for npages := b.rx.tree.size.overflowPages(size); npages > 0; npages-- {
+		page := b.rx.tree.get(ptr)
+		if page.btype() != BNODE_OVERFLOW {
+			panic(&PageError{Ptr: ptr, Msg: "not an overflow page"})
+		}
+		ptr = binary.LittleEndian.Uint64(page.Data[4:])
+
+		out := make([]byte, b.rx.db.PageSize)
+		copy(out, page.Data)
+		next := b.next + 1
+		if npages == 1 {
+			next = 0
+		}
+		binary.LittleEndian.PutUint64(out[4:], next)
+		if _, err := b.write(out); err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+func (b *backup) write(page []byte) (uint64, error) {
+	if _, err := b.w.Write(pageSeal(page, b.rx.db.PageSize)); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	b.next++
+	return b.next - 1, nil
+}
@@ -0,0 +1,114 @@
+package bplustree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a writer that fails after some bytes
+type failWriter struct {
+	left int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		return 0, errInjected
+	}
+	w.left -= len(p)
+	return len(p), nil
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := openTestPager(t, path)
+	defer db.Close()
+
+	ref := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := fmt.Sprintf("val%d", i)
+		if i%100 == 0 {
+			val = string(bytes.Repeat([]byte(val), 2000)) // overflow pages
+		}
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ref[key] = val
+	}
+	for i := 0; i < 3000; i += 3 {
+		db.Del([]byte(fmt.Sprintf("key%d", i)))
+		delete(ref, fmt.Sprintf("key%d", i))
+	}
+	db.Tree("names").Set([]byte("winnie"), []byte("stella"))
+
+	// the writer is not blocked by the backup of an older snapshot
+	rx := db.BeginRead()
+	for i := 1; i < 3000; i += 3 {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("new")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Tree("names").Set([]byte("winnie"), []byte("new"))
+	buf := bytes.Buffer{}
+	if err := rx.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	rx.Done()
+
+	// the copy has no unused pages
+	if buf.Len() >= int(fileSize(t, path)) {
+		t.Fatalf("the backup is not compacted: %d bytes", buf.Len())
+	}
+	copyPath := filepath.Join(dir, "copy.db")
+	if err := os.WriteFile(copyPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	backup := openTestPager(t, copyPath)
+	defer backup.Close()
+	if errs := backup.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	if !checkContent(t, backup, ref) {
+		t.Fatalf("the backup does not match the snapshot")
+	}
+	if val, _, _ := backup.Tree("names").Get([]byte("winnie")); string(val) != "stella" {
+		t.Fatalf("named tree: %q", val)
+	}
+	// and it's usable
+	if err := backup.Set([]byte("key0"), []byte("val0")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if errs := backup.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify after update: %v", errs)
+	}
+
+	if err := db.Backup(&failWriter{left: 3 * BTREE_PAGE_SIZE}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+}
+
+func TestBackupEmpty(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+	buf := bytes.Buffer{}
+	if err := db.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	store := NewMemoryStore()
+	for ptr := 0; ptr*BTREE_PAGE_SIZE < buf.Len(); ptr++ {
+		store.WritePage(uint64(ptr), buf.Bytes()[ptr*BTREE_PAGE_SIZE:][:BTREE_PAGE_SIZE])
+	}
+	backup := &Pager{Store: store}
+	if err := backup.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if errs := backup.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
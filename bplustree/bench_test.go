@@ -0,0 +1,111 @@
+package bplustree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// the linear scan NodeLookupLE() used to do, for comparison
+func nodeLookupLELinear(node BNode, key []byte) uint16 {
+	nkeys := node.nkeys()
+	found := uint16(0)
+	for i := uint16(1); i < nkeys; i++ {
+		cmp := bytes.Compare(node.GetKey(i), key)
+		if cmp <= 0 {
+			found = i
+		}
+		if cmp >= 0 {
+			break
+		}
+	}
+	return found
+}
+
+func TestNodeLookupLE(t *testing.T) {
+	c := newC()
+	for i := 0; i < 100; i++ {
+		c.add(string(benchKey(uint64(i*2))), "")
+	}
+	root := c.tree.get(c.tree.Root)
+	for i := 0; i < 250; i++ {
+		key := benchKey(uint64(i))
+		if got, want := NodeLookupLE(root, key), nodeLookupLELinear(root, key); got != want {
+			t.Fatalf("NodeLookupLE(%d): got %d, expected %d", i, got, want)
+		}
+	}
+}
+
+const benchKeys = 1 << 20
+
+func benchKey(i uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, i*2654435761%benchKeys) // scattered
+	return key
+}
+
+var bench struct {
+	once sync.Once
+	c    *C
+}
+
+// a tree of 1M keys, built once for all benchmarks
+func benchTree(b *testing.B) *C {
+	bench.once.Do(func() {
+		c := newC()
+		for i := uint64(0); i < benchKeys; i++ {
+			c.tree.Insert(benchKey(i), []byte("value"))
+		}
+		bench.c = c
+	})
+	b.ResetTimer()
+	return bench.c
+}
+
+func BenchmarkGet1M(b *testing.B) {
+	c := benchTree(b)
+	for i := 0; i < b.N; i++ {
+		if _, ok := c.tree.Get(benchKey(uint64(rand.Intn(benchKeys)))); !ok {
+			b.Fatal("key not found")
+		}
+	}
+}
+
+func BenchmarkGetMissing1M(b *testing.B) {
+	c := benchTree(b)
+	for i := 0; i < b.N; i++ {
+		key := append(benchKey(uint64(rand.Intn(benchKeys))), 0)
+		if _, ok := c.tree.Get(key); ok {
+			b.Fatal("unexpected key")
+		}
+	}
+}
+
+func BenchmarkInsert1M(b *testing.B) {
+	c := benchTree(b)
+	for i := 0; i < b.N; i++ {
+		c.tree.Insert(benchKey(uint64(rand.Intn(benchKeys))), []byte("updated"))
+	}
+}
+
+func benchLeaf(b *testing.B) BNode {
+	c := benchTree(b)
+	iter := c.tree.SeekGE(benchKey(0))
+	return iter.path[len(iter.path)-1]
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	leaf := benchLeaf(b)
+	for i := 0; i < b.N; i++ {
+		NodeLookupLE(leaf, leaf.GetKey(uint16(i)%leaf.nkeys()))
+	}
+}
+
+func BenchmarkNodeLookupLELinear(b *testing.B) {
+	leaf := benchLeaf(b)
+	for i := 0; i < b.N; i++ {
+		nodeLookupLELinear(leaf, leaf.GetKey(uint16(i)%leaf.nkeys()))
+	}
+}
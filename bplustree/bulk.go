@@ -0,0 +1,293 @@
+package bplustree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ------------------------------------------------
+// the bulk loader builds a tree bottom up from keys in ascending order.
+// leaves are packed until the next key doesn't fit, then the leaf is
+// written and its first key goes to the level above, and so on.
+// each page is written once, instead of copying a path for each key.
+// merged into an existing tree, only the subtrees in the range of the
+// new keys are rebuilt, the others are added to the builder as they are.
+// ------------------------------------------------
+
+var ErrNotSorted = errors.New("keys are not in ascending order")
+
+// a KV waiting for its node to be written
+type builderKV struct {
+	key []byte
+	val []byte
+	ptr uint64
+	ovf bool
+}
+
+type builderLevel struct {
+	kvs     []builderKV
+	kvBytes int  // the size of the KVs, see nodeAppendKV()
+	written bool // a node of this level is written
+}
+
+type treeBuilder struct {
+	tree   *BTree
+	levels []builderLevel // leaves first
+}
+
+func newTreeBuilder(tree *BTree) *treeBuilder {
+	b := &treeBuilder{tree: tree}
+	// the dummy key, see BTree.Insert()
+	b.add(0, builderKV{})
+	return b
+}
+
+func (b *treeBuilder) add(level int, kv builderKV) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, builderLevel{})
+	}
+	l := &b.levels[level]
+	// the page size with the KV, see nodeRangeSize()
+	n, kvBytes := len(l.kvs)+1, l.kvBytes+4+len(kv.key)+len(kv.val)
+	size := HEADER + 8*n + 2*n + kvBytes
+	if level == 0 && len(l.kvs) > 0 {
+		plen := commonPrefix(l.kvs[0].key, kv.key)
+		size = HEADER + 2 + plen + 2*n + kvBytes - n*plen
+	}
+	plain := HEADER + 8*n + 2*n + kvBytes
+	if len(l.kvs) > 0 && (size > b.tree.size.node || plain > b.tree.size.plainMax) {
+		b.flush(level)
+		l = &b.levels[level]
+		kvBytes = 4 + len(kv.key) + len(kv.val)
+	}
+	l.kvs = append(l.kvs, kv)
+	l.kvBytes = kvBytes
+}
+
+// add the pointer to an existing subtree to a level, the levels below
+// are written first to keep the key order.
+func (b *treeBuilder) addSubtree(level int, kv builderKV) {
+	for i := 0; i < level; i++ {
+		if i < len(b.levels) && len(b.levels[i].kvs) > 0 {
+			b.flush(i)
+		}
+	}
+	for len(b.levels) < level {
+		b.levels = append(b.levels, builderLevel{})
+	}
+	b.add(level, kv)
+}
+
+// write the node of a level and add it to the level above
+func (b *treeBuilder) flush(level int) {
+	l := &b.levels[level]
+	btype := uint16(BNODE_NODE)
+	if level == 0 {
+		btype = BNODE_LEAF
+	}
+	node := BNode{Data: make([]byte, HEADER+10*len(l.kvs)+l.kvBytes)}
+	node.setHeader(btype, uint16(len(l.kvs)))
+	for i, kv := range l.kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+		if kv.ovf {
+			node.setValOverflow(uint16(i))
+		}
+	}
+	first := node.GetKey(0)
+	l.kvs, l.kvBytes, l.written = l.kvs[:0], 0, true
+	b.add(level+1, builderKV{key: first, ptr: b.tree.newNode(node)})
+}
+
+// write the remaining nodes, returns the root.
+func (b *treeBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		l := &b.levels[level]
+		if level == len(b.levels)-1 && !l.written {
+			if level > 0 && len(l.kvs) == 1 {
+				return l.kvs[0].ptr // an existing subtree is the root
+			}
+			// the only node of the top level
+			b.flush(level)
+			return b.levels[level+1].kvs[0].ptr
+		}
+		if len(l.kvs) > 0 {
+			b.flush(level)
+		}
+	}
+}
+
+// merge the new KVs below hi (nil for no bound) into a subtree at a level
+// of the builder. the subtrees without new KVs are kept, the pages of the
+// others are freed. overflow pages are kept, the builder takes over the
+// references.
+func treeMerge(b *treeBuilder, ptr uint64, level int, hi []byte, m *treeMerger) error {
+	tree := b.tree
+	node := tree.get(ptr)
+	tree.del(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kidHi := hi
+			if i+1 < node.nkeys() {
+				kidHi = node.GetKey(i + 1)
+			}
+			if !m.before(kidHi) {
+				b.addSubtree(level, builderKV{key: node.GetKey(i), ptr: node.getPtr(i)})
+				continue
+			}
+			if err := treeMerge(b, node.getPtr(i), level-1, kidHi, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := uint16(0); i < node.nkeys(); i++ {
+		old := builderKV{key: node.GetKey(i), val: node.GetVal(i), ovf: node.valOverflow(i)}
+		for m.before(old.key) || (m.kv != nil && bytes.Equal(m.kv.key, old.key)) {
+			if bytes.Equal(m.kv.key, old.key) {
+				if old.ovf {
+					overflowFree(tree, old.val)
+				}
+				old = *m.kv
+			} else {
+				b.add(0, *m.kv)
+			}
+			if err := m.pull(); err != nil {
+				return err
+			}
+		}
+		b.add(0, old)
+	}
+	for m.before(hi) {
+		b.add(0, *m.kv)
+		if err := m.pull(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the new KVs of treeLoad()
+type treeMerger struct {
+	tree *BTree
+	next func() ([]byte, []byte, bool)
+	kv   *builderKV // the next new KV, nil when there are no more
+	prev []byte
+}
+
+func (m *treeMerger) pull() error {
+	m.kv = nil
+	key, val, ok := m.next()
+	if !ok {
+		return nil
+	}
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if m.prev != nil && bytes.Compare(m.prev, key) >= 0 {
+		return fmt.Errorf("%w: %q after %q", ErrNotSorted, key, m.prev)
+	}
+	// the caller can reuse its buffers
+	key, val = bytes.Clone(key), bytes.Clone(val)
+	m.prev = key
+	m.kv = &builderKV{key: key, val: val}
+	if len(val) > m.tree.size.maxVal {
+		m.kv.val, m.kv.ovf = overflowStore(m.tree, val), true
+	}
+	return nil
+}
+
+// the next new key is below hi, nil for no bound
+func (m *treeMerger) before(hi []byte) bool {
+	return m.kv != nil && (hi == nil || bytes.Compare(m.kv.key, hi) < 0)
+}
+
+// merge KVs in ascending key order into a tree, returns the new root.
+// the subtrees in the range of the new KVs are rebuilt in 1 pass over
+// the old and the new KVs, a new value replaces the old one of the same key.
+func treeLoad(tree *BTree, next func() ([]byte, []byte, bool)) (uint64, error) {
+	m := &treeMerger{tree: tree, next: next}
+	if err := m.pull(); err != nil {
+		return 0, err
+	}
+	if m.kv == nil {
+		return tree.Root, nil
+	}
+
+	if tree.Root == 0 {
+		b := newTreeBuilder(tree)
+		for m.kv != nil {
+			b.add(0, *m.kv)
+			if err := m.pull(); err != nil {
+				return 0, err
+			}
+		}
+		return b.finish(), nil
+	}
+
+	// the old dummy key is merged like the other keys
+	b := &treeBuilder{tree: tree}
+	height := 1
+	for node := tree.get(tree.Root); node.btype() == BNODE_NODE; node = tree.get(node.getPtr(0)) {
+		height++
+	}
+	if err := treeMerge(b, tree.Root, height-1, nil, m); err != nil {
+		return 0, err
+	}
+	return b.finish(), nil
+}
+
+// merge KVs in ascending key order into the default tree. each page in
+// the range of the keys is rewritten once, which is cheaper than Set()
+// for many keys.
+// a new value replaces the old value of the same key.
+// the transaction is aborted if a key is bad or out of order.
+func (tx *Tx) Load(next func() (key []byte, val []byte, ok bool)) (err error) {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	defer tx.recoverPage(&err)
+	root, err := treeLoad(&tx.db.tree, next)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.db.tree.Root = root
+	return nil
+}
+
+// see Tx.Load()
+func (t *Tree) Load(next func() (key []byte, val []byte, ok bool)) (err error) {
+	if t.rx != nil {
+		return ErrReadOnly
+	}
+	if t.tx == nil {
+		tx := t.db.Begin()
+		if err := tx.Tree(t.name).Load(next); err != nil {
+			tx.Abort()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if err := t.tx.check(); err != nil {
+		return err
+	}
+	if err := t.db.treeCreate(t.name); err != nil {
+		return err
+	}
+	defer t.tx.recoverPage(&err)
+	tree := t.db.namedTree(t.name)
+	root, err := treeLoad(&tree, next)
+	if err != nil {
+		t.tx.Abort()
+		return err
+	}
+	if root == 0 {
+		delete(t.db.roots, t.name) // nothing was loaded into a new tree
+	} else {
+		t.db.roots[t.name] = root
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package bplustree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// iterate over the sorted keys of a map
+func sortedKVs(kvs map[string]string) func() ([]byte, []byte, bool) {
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return func() ([]byte, []byte, bool) {
+		if len(keys) == 0 {
+			return nil, nil, false
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return []byte(key), []byte(kvs[key]), true
+	}
+}
+
+func TestLoad(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+
+	ref := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		val := fmt.Sprintf("val%d", i)
+		if i%1000 == 0 {
+			val = fmt.Sprintf("%0*d", BTREE_PAGE_SIZE*2, i) // overflow pages
+		}
+		ref[fmt.Sprintf("key%08d", i)] = val
+	}
+	tx := db.Begin()
+	if err := tx.Load(sortedKVs(ref)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	if !checkContent(t, db, ref) {
+		t.Fatalf("the content does not match")
+	}
+
+	// the leaves are packed
+	other := openTestPager(t, MEMORY_PATH)
+	defer other.Close()
+	for key, val := range ref {
+		other.Set([]byte(key), []byte(val))
+	}
+	if loaded, inserted := db.page.flushed, other.page.flushed-uint64(other.free.Total()); loaded >= inserted {
+		t.Fatalf("%d pages after loading, %d after inserting", loaded, inserted)
+	}
+
+	// merged into the existing keys
+	more := map[string]string{}
+	for i := 0; i < 20000; i += 7 {
+		more[fmt.Sprintf("key%08d", i)] = "new"      // replaced
+		more[fmt.Sprintf("key%08d-", i)] = "new key" // between the old keys
+	}
+	more["a"] = "first"
+	more["z"] = "last"
+	if err := db.Tree("tree").Load(sortedKVs(more)); err != nil {
+		t.Fatalf("Load into a new tree: %v", err)
+	}
+	tx = db.Begin()
+	if err := tx.Load(sortedKVs(more)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	for key, val := range more {
+		ref[key] = val
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify after merging: %v", errs)
+	}
+	if !checkContent(t, db, ref) {
+		t.Fatalf("the content does not match after merging")
+	}
+	if val, _, _ := db.Tree("tree").Get([]byte("z")); string(val) != "last" {
+		t.Fatalf("named tree: %q", val)
+	}
+	// and it can still be updated
+	for i := 0; i < 20000; i += 3 {
+		db.Del([]byte(fmt.Sprintf("key%08d", i)))
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify after deleting: %v", errs)
+	}
+}
+
+func TestLoadNotSorted(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+	db.Set([]byte("key"), []byte("val"))
+
+	keys := []string{"a", "c", "b"}
+	next := func() ([]byte, []byte, bool) {
+		if len(keys) == 0 {
+			return nil, nil, false
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return []byte(key), nil, true
+	}
+	tx := db.Begin()
+	if err := tx.Load(next); !errors.Is(err, ErrNotSorted) {
+		t.Fatalf("expected ErrNotSorted, got %v", err)
+	}
+	// the transaction is aborted
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("expected ErrTxDone, got %v", err)
+	}
+	if !checkContent(t, db, map[string]string{"key": "val"}) {
+		t.Fatalf("the content was changed")
+	}
+	if err := db.Tree("empty").Load(sortedKVs(nil)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(db.Trees()) != 0 {
+		t.Fatalf("an empty tree was created: %v", db.Trees())
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+// the leaves of the default tree by their first key
+func leafPtrs(db *Pager) map[string]uint64 {
+	leaves := map[string]uint64{}
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := db.tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			leaves[string(node.GetKey(0))] = ptr
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			walk(node.getPtr(i))
+		}
+	}
+	walk(db.tree.Root)
+	return leaves
+}
+
+// only the leaves in the range of the new keys are rewritten
+func TestLoadRange(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+
+	ref := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		ref[fmt.Sprintf("a%08d", i)] = fmt.Sprintf("val%d", i)
+		ref[fmt.Sprintf("c%08d", i)] = fmt.Sprintf("val%d", i)
+	}
+	tx := db.Begin()
+	if err := tx.Load(sortedKVs(ref)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	before := leafPtrs(db)
+
+	more := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		more[fmt.Sprintf("b%08d", i)] = "new"
+	}
+	tx = db.Begin()
+	if err := tx.Load(sortedKVs(more)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	for key, val := range more {
+		ref[key] = val
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	if !checkContent(t, db, ref) {
+		t.Fatalf("the content does not match")
+	}
+
+	// the new keys go to the last leaf before them
+	last := ""
+	for first := range before {
+		if first < "b" {
+			last = max(last, first)
+		}
+	}
+	after := leafPtrs(db)
+	for first, ptr := range before {
+		if first != last && after[first] != ptr {
+			t.Fatalf("leaf %q was moved from %d to %d", first, ptr, after[first])
+		}
+	}
+}
+
+// random merges match a map
+func TestLoadRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+
+	ref := map[string]string{}
+	for round := 0; round < 50; round++ {
+		kvs := map[string]string{}
+		for n := rng.Intn(3000); n > 0; n-- {
+			kvs[fmt.Sprintf("key%d", rng.Intn(10000))] = fmt.Sprintf("val%d", rng.Int())
+		}
+		if err := db.Tree("tree").Load(sortedKVs(kvs)); err != nil {
+			t.Fatalf("round %d: Load: %v", round, err)
+		}
+		for key, val := range kvs {
+			ref[key] = val
+		}
+	}
+	count := 0
+	db.Tree("tree").Scan([]byte("key"), nil, func(key []byte, val []byte) bool {
+		count++
+		if ref[string(key)] != string(val) {
+			t.Fatalf("%q = %q, expected %q", key, val, ref[string(key)])
+		}
+		return true
+	})
+	if count != len(ref) {
+		t.Fatalf("%d keys, expected %d", count, len(ref))
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+const benchLoadKeys = 100000
+
+// the keys of a CREATE INDEX, sorted first for the bulk loader
+func BenchmarkLoad100K(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		db := &Pager{Path: MEMORY_PATH}
+		if err := db.Open(); err != nil {
+			b.Fatal(err)
+		}
+		keys := make([][]byte, benchLoadKeys)
+		for j := range keys {
+			keys[j] = benchKey(uint64(j))
+		}
+		sort.Slice(keys, func(x, y int) bool { return bytes.Compare(keys[x], keys[y]) < 0 })
+		tx := db.Begin()
+		err := tx.Load(func() ([]byte, []byte, bool) {
+			if len(keys) == 0 {
+				return nil, nil, false
+			}
+			key := keys[0]
+			keys = keys[1:]
+			return key, []byte("value"), true
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the same keys inserted 1 by 1 in a transaction
+func BenchmarkSetTx100K(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		db := &Pager{Path: MEMORY_PATH}
+		if err := db.Open(); err != nil {
+			b.Fatal(err)
+		}
+		tx := db.Begin()
+		for j := uint64(0); j < benchLoadKeys; j++ {
+			if err := tx.Set(benchKey(j), []byte("value")); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package bplustree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+)
+
+// ------------------------------------------------
+// catalog layout, after the fixed part of the master page
+//  count     name length  name   root
+// | 2 bytes | 2 bytes    | ...  | 8 bytes | ... more names
+// ------------------------------------------------
+// the catalog maps names to the roots of independent trees in the same file.
+// the tree at the master page root is the default tree without a name.
+
+const MAX_TREE_NAME = 255
+
+var ErrBadTreeName = fmt.Errorf("tree names must have 1 to %d bytes", MAX_TREE_NAME)
+var ErrCatalogFull = errors.New("the catalog does not fit in the master page")
+var ErrReadOnly = errors.New("read-only")
+
+func checkTreeName(name string) error {
+	if len(name) == 0 || len(name) > MAX_TREE_NAME {
+		return fmt.Errorf("%w: %q", ErrBadTreeName, name)
+	}
+	return nil
+}
+
+func catalogSize(roots map[string]uint64) int {
+	size := 2
+	for name := range roots {
+		size += 2 + len(name) + 8
+	}
+	return size
+}
+
+// append the catalog to the master page
+func catalogEncode(data []byte, roots map[string]uint64) []byte {
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(names)))
+	for _, name := range names {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(name)))
+		data = append(data, name...)
+		data = binary.LittleEndian.AppendUint64(data, roots[name])
+	}
+	return data
+}
+
+// parse the catalog, returns the roots and the bytes used.
+func catalogDecode(data []byte) (map[string]uint64, int, error) {
+	bad := errors.New("Bad catalog.")
+	if len(data) < 2 {
+		return nil, 0, bad
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	pos := 2
+	roots := map[string]uint64{}
+	for i := 0; i < count; i++ {
+		if pos+2 > len(data) {
+			return nil, 0, bad
+		}
+		nlen := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if nlen == 0 || nlen > MAX_TREE_NAME || pos+nlen+8 > len(data) {
+			return nil, 0, bad
+		}
+		name := string(data[pos : pos+nlen])
+		roots[name] = binary.LittleEndian.Uint64(data[pos+nlen:])
+		pos += nlen + 8
+	}
+	if len(roots) != count {
+		return nil, 0, bad // duplicated names
+	}
+	return roots, pos, nil
+}
+
+// a named tree in the database file.
+// a Tree from Pager.Tree() commits each update on its own,
+// one from Tx.Tree() or ReadTx.Tree() is a part of that transaction.
+type Tree struct {
+	db   *Pager
+	name string
+	tx   *Tx
+	rx   *ReadTx
+}
+
+// a tree is created by the first update that uses its name
+func (db *Pager) Tree(name string) *Tree {
+	return &Tree{db: db, name: name}
+}
+
+func (tx *Tx) Tree(name string) *Tree {
+	return &Tree{db: tx.db, name: name, tx: tx}
+}
+
+func (rx *ReadTx) Tree(name string) *Tree {
+	return &Tree{db: rx.db, name: name, rx: rx}
+}
+
+// names of the existing trees in the committed version
+func (db *Pager) Trees() []string {
+	db.mu.Lock()
+	names := make([]string, 0, len(db.snap.roots))
+	for name := range db.snap.roots {
+		names = append(names, name)
+	}
+	db.mu.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+func (t *Tree) Name() string {
+	return t.name
+}
+
+func (t *Tree) Get(key []byte) (val []byte, found bool, err error) {
+	switch {
+	case t.tx != nil:
+		defer recoverPageError(&err)
+		tree := t.db.namedTree(t.name)
+		val, found = tree.Get(key)
+		return val, found, nil
+	case t.rx != nil:
+		defer recoverPageError(&err)
+		tree := t.rx.namedTree(t.name)
+		val, found = tree.Get(key)
+		return val, found, nil
+	default:
+		rx := t.db.BeginRead()
+		defer rx.Done()
+		return rx.Tree(t.name).Get(key)
+	}
+}
+
+// see Pager.Scan()
+func (t *Tree) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) (err error) {
+	switch {
+	case t.tx != nil:
+		defer recoverPageError(&err)
+		tree := t.db.namedTree(t.name)
+		treeScan(&tree, start, end, fn)
+		return nil
+	case t.rx != nil:
+		defer recoverPageError(&err)
+		tree := t.rx.namedTree(t.name)
+		treeScan(&tree, start, end, fn)
+		return nil
+	default:
+		rx := t.db.BeginRead()
+		defer rx.Done()
+		return rx.Tree(t.name).Scan(start, end, fn)
+	}
+}
+
+func (t *Tree) Set(key []byte, val []byte) (err error) {
+	if t.rx != nil {
+		return ErrReadOnly
+	}
+	if t.tx == nil {
+		tx := t.db.Begin()
+		if err := tx.Tree(t.name).Set(key, val); err != nil {
+			tx.Abort()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if err := t.tx.check(); err != nil {
+		return err
+	}
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if err := t.db.treeCreate(t.name); err != nil {
+		return err
+	}
+	defer t.tx.recoverPage(&err)
+	tree := t.db.namedTree(t.name)
+	tree.Insert(key, val)
+	t.db.roots[t.name] = tree.Root
+	return nil
+}
+
+func (t *Tree) Del(key []byte) (deleted bool, err error) {
+	if t.rx != nil {
+		return false, ErrReadOnly
+	}
+	if t.tx == nil {
+		tx := t.db.Begin()
+		deleted, err := tx.Tree(t.name).Del(key)
+		if err != nil {
+			tx.Abort()
+			return false, err
+		}
+		return deleted, tx.Commit()
+	}
+
+	if err := t.tx.check(); err != nil {
+		return false, err
+	}
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	if _, ok := t.db.roots[t.name]; !ok {
+		return false, nil
+	}
+	defer t.tx.recoverPage(&err)
+	tree := t.db.namedTree(t.name)
+	deleted = tree.Delete(key)
+	t.db.roots[t.name] = tree.Root
+	return deleted, nil
+}
+
+// add a name to the catalog if it's new
+func (db *Pager) treeCreate(name string) error {
+	if _, ok := db.roots[name]; ok {
+		return nil
+	}
+	if err := checkTreeName(name); err != nil {
+		return err
+	}
+	roots := maps.Clone(db.roots)
+	roots[name] = 0
+	if err := db.catalogFits(roots); err != nil {
+		return err
+	}
+	db.roots[name] = 0
+	return nil
+}
+
+// the error of the first update of each new name in the committed
+// catalog, without the updates
+func (db *Pager) CheckTrees(names ...string) error {
+	db.mu.Lock()
+	roots := maps.Clone(db.snap.roots)
+	db.mu.Unlock()
+	for _, name := range names {
+		if _, ok := roots[name]; ok {
+			continue
+		}
+		if err := checkTreeName(name); err != nil {
+			return err
+		}
+		roots[name] = 0
+	}
+	return db.catalogFits(roots)
+}
+
+func (db *Pager) catalogFits(roots map[string]uint64) error {
+	size := MASTER_SIZE + 8 + catalogSize(roots) // with the counter
+	if db.PageSize != BTREE_PAGE_SIZE {
+		size += 4
+	}
+	if size > MASTER_SLOT_SIZE {
+		return ErrCatalogFull
+	}
+	return nil
+}
+
+// the named tree in the current transaction
+func (db *Pager) namedTree(name string) BTree {
+	tree := db.tree // the same callbacks
+	tree.Root = db.roots[name]
+	return tree
+}
+
+// the named tree in the snapshot
+func (rx *ReadTx) namedTree(name string) BTree {
+	tree := rx.tree
+	tree.Root = rx.roots[name]
+	return tree
+}
@@ -0,0 +1,154 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNamedTrees(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	// the same keys in different trees don't collide
+	names := []string{"users", "users.id", "orders"}
+	for _, name := range names {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			if err := db.Tree(name).Set(key, []byte(name)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	db.Set([]byte("key1"), []byte("default"))
+	if deleted, err := db.Tree("orders").Del([]byte("key1")); err != nil || !deleted {
+		t.Fatalf("Del: %t, %v", deleted, err)
+	}
+	if deleted, _ := db.Tree("missing").Del([]byte("key1")); deleted {
+		t.Fatalf("Del: deleted from a missing tree")
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	db.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	if got := db.Trees(); !reflect.DeepEqual(got, []string{"orders", "users", "users.id"}) {
+		t.Fatalf("Trees: %v", got)
+	}
+	for _, name := range names {
+		count := 0
+		db.Tree(name).Scan([]byte("key"), nil, func(key []byte, val []byte) bool {
+			if string(val) != name {
+				t.Fatalf("%s: %q = %q", name, key, val)
+			}
+			count++
+			return true
+		})
+		expected := 1000
+		if name == "orders" {
+			expected--
+		}
+		if count != expected {
+			t.Fatalf("%s: %d keys, expected %d", name, count, expected)
+		}
+	}
+	if val, ok, _ := db.Get("key1"); !ok || string(val) != "default" {
+		t.Fatalf("default tree: %q (%t)", val, ok)
+	}
+	if _, ok, _ := db.Tree("missing").Get([]byte("key1")); ok {
+		t.Fatalf("Get: found a key in a missing tree")
+	}
+}
+
+func TestNamedTreesTx(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+	db.Tree("a").Set([]byte("k"), []byte("old"))
+
+	// updates to several trees are aborted together
+	tx := db.Begin()
+	tx.Tree("a").Set([]byte("k"), []byte("new"))
+	tx.Tree("b").Set([]byte("k"), []byte("new"))
+	if val, _, _ := tx.Tree("b").Get([]byte("k")); string(val) != "new" {
+		t.Fatalf("tx: %q", val)
+	}
+	tx.Abort()
+	if val, _, _ := db.Tree("a").Get([]byte("k")); string(val) != "old" {
+		t.Fatalf("after abort: %q", val)
+	}
+	if len(db.Trees()) != 1 {
+		t.Fatalf("after abort: %v", db.Trees())
+	}
+
+	// and committed together
+	rx := db.BeginRead()
+	tx = db.Begin()
+	tx.Tree("a").Set([]byte("k"), []byte("new"))
+	tx.Tree("b").Set([]byte("k"), []byte("new"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if val, _, _ := db.Tree(name).Get([]byte("k")); string(val) != "new" {
+			t.Fatalf("%s: %q", name, val)
+		}
+	}
+
+	// the snapshot is not affected
+	if val, _, _ := rx.Tree("a").Get([]byte("k")); string(val) != "old" {
+		t.Fatalf("snapshot: %q", val)
+	}
+	if _, ok, _ := rx.Tree("b").Get([]byte("k")); ok {
+		t.Fatalf("snapshot: found a key in a newer tree")
+	}
+	if err := rx.Tree("a").Set([]byte("k"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	rx.Done()
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+func TestCatalogFull(t *testing.T) {
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+
+	if err := db.Tree("").Set([]byte("k"), nil); !errors.Is(err, ErrBadTreeName) {
+		t.Fatalf("expected ErrBadTreeName, got %v", err)
+	}
+	if err := db.CheckTrees("a", strings.Repeat("t", MAX_TREE_NAME+1)); !errors.Is(err, ErrBadTreeName) {
+		t.Fatalf("CheckTrees: expected ErrBadTreeName, got %v", err)
+	}
+	n := 0
+	for ; ; n++ {
+		name := fmt.Sprintf("%s%d", strings.Repeat("t", 100), n)
+		// the same error as the update
+		checked := db.CheckTrees(name)
+		err := db.Tree(name).Set([]byte("k"), nil)
+		if !errors.Is(checked, err) {
+			t.Fatalf("CheckTrees: %v, Set: %v", checked, err)
+		}
+		if errors.Is(err, ErrCatalogFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if n == 0 || len(db.Trees()) != n {
+		t.Fatalf("%d trees created, %d listed", n, len(db.Trees()))
+	}
+	// existing trees can still be updated
+	if err := db.Tree(db.Trees()[0]).Set([]byte("k2"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
@@ -0,0 +1,324 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"testing"
+)
+
+var errInjected = errors.New("injected fault")
+
+// a PageStore that fails on purpose.
+// written pages are lost by a crash unless they are synced.
+type faultStore struct {
+	rng      *rand.Rand
+	durable  map[uint64][]byte // survives a crash
+	volatile map[uint64][]byte // written but not synced
+	npages   uint64
+	ops      int  // writes and syncs so far
+	failAt   int  // the op that fails, 0 for none
+	torn     bool // the failed write leaves half of a page behind
+}
+
+func newFaultStore(rng *rand.Rand) *faultStore {
+	return &faultStore{rng: rng, durable: map[uint64][]byte{}, volatile: map[uint64][]byte{}}
+}
+
+// a new store with the disk content after a crash:
+// each page that is not synced may or may not have been written back.
+func (s *faultStore) crash() *faultStore {
+	disk := newFaultStore(s.rng)
+	disk.durable = maps.Clone(s.durable)
+	for ptr, page := range s.volatile {
+		if s.rng.Intn(2) == 0 {
+			disk.durable[ptr] = page
+		}
+	}
+	for ptr := range disk.durable {
+		disk.npages = max(disk.npages, ptr+1)
+	}
+	return disk
+}
+
+// fail the nth op from now
+func (s *faultStore) failAfter(n int, torn bool) {
+	s.failAt = s.ops + n
+	s.torn = torn
+}
+
+func (s *faultStore) fault() bool {
+	s.ops++
+	return s.ops == s.failAt
+}
+
+func (s *faultStore) Open() (uint64, error) {
+	return s.npages, nil
+}
+
+func (s *faultStore) SetPageSize(size int) (uint64, error) {
+	if size != BTREE_PAGE_SIZE {
+		return 0, fmt.Errorf("bad page size %d", size)
+	}
+	return s.npages, nil
+}
+
+func (s *faultStore) Close() error {
+	return nil
+}
+
+func (s *faultStore) ReadPage(ptr uint64) ([]byte, error) {
+	if page, ok := s.volatile[ptr]; ok {
+		return page, nil
+	}
+	if page, ok := s.durable[ptr]; ok {
+		return page, nil
+	}
+	if ptr < s.npages {
+		return make([]byte, BTREE_PAGE_SIZE), nil // a hole
+	}
+	return nil, fmt.Errorf("page %d is out of %d pages", ptr, s.npages)
+}
+
+func (s *faultStore) WritePage(ptr uint64, page []byte) error {
+	data := make([]byte, BTREE_PAGE_SIZE)
+	if prev, err := s.ReadPage(ptr); err == nil {
+		copy(data, prev)
+	}
+	n := len(page)
+	failed := s.fault()
+	if failed && s.torn {
+		n /= 2
+	} else if failed {
+		return errInjected
+	}
+	copy(data, page[:n])
+	if n == len(page) {
+		clear(data[n:])
+	}
+	s.volatile[ptr] = data
+	s.npages = max(s.npages, ptr+1)
+	if failed {
+		return errInjected
+	}
+	return nil
+}
+
+func (s *faultStore) WriteMaster(offset int, data []byte) error {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if old, err := s.ReadPage(0); err == nil {
+		copy(page, old)
+	}
+	failed := s.fault()
+	if failed && !s.torn {
+		return errInjected
+	}
+	if failed {
+		data = data[:len(data)/2]
+	}
+	copy(page[offset:], data)
+	s.volatile[0] = page
+	s.npages = max(s.npages, 1)
+	if failed {
+		return errInjected
+	}
+	return nil
+}
+
+func (s *faultStore) Sync() error {
+	if s.fault() {
+		return errInjected
+	}
+	maps.Copy(s.durable, s.volatile)
+	clear(s.volatile)
+	return nil
+}
+
+// random updates of a transaction, applied to a copy of the reference
+func randomTx(rng *rand.Rand, tx *Tx, ref map[string]string) (map[string]string, error) {
+	next := maps.Clone(ref)
+	for n := 1 + rng.Intn(50); n > 0; n-- {
+		key := fmt.Sprintf("key%d", rng.Intn(500))
+		if rng.Intn(3) == 0 {
+			if _, err := tx.Del([]byte(key)); err != nil {
+				return nil, err
+			}
+			delete(next, key)
+			continue
+		}
+		val := fmt.Sprintf("val%d", rng.Int())
+		if rng.Intn(20) == 0 {
+			val = fmt.Sprintf("%0*d", BTREE_PAGE_SIZE*2, rng.Int()) // overflow pages
+		}
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			return nil, err
+		}
+		next[key] = val
+	}
+	return next, nil
+}
+
+func checkContent(t *testing.T, db *Pager, ref map[string]string) bool {
+	t.Helper()
+	count := 0
+	ok := true
+	db.Scan([]byte{}, nil, func(key []byte, val []byte) bool {
+		count++
+		if ref[string(key)] != string(val) {
+			ok = false
+		}
+		return ok
+	})
+	return ok && count == len(ref)
+}
+
+// crash in the middle of a commit, the reopened database is
+// either the last committed version or the one being committed.
+func TestPagerCrashConsistency(t *testing.T) {
+	for round := 0; round < 300; round++ {
+		rng := rand.New(rand.NewSource(int64(round)))
+		store := newFaultStore(rng)
+		db := &Pager{Store: store}
+		if err := db.Open(); err != nil {
+			t.Fatalf("round %d: Open: %v", round, err)
+		}
+
+		ref := map[string]string{}
+		var next map[string]string
+		crashAt := 10 + rng.Intn(20)
+		for i := 0; ; i++ {
+			if i == crashAt {
+				store.failAfter(1+rng.Intn(40), rng.Intn(2) == 0)
+			}
+			tx := db.Begin()
+			var err error
+			next, err = randomTx(rng, tx, ref)
+			if err != nil {
+				t.Fatalf("round %d: update: %v", round, err)
+			}
+			if err = tx.Commit(); err != nil {
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("round %d: Commit: %v", round, err)
+				}
+				break // crash
+			}
+			ref = next
+		}
+
+		db = &Pager{Store: store.crash()}
+		if err := db.Open(); err != nil {
+			t.Fatalf("round %d: reopen: %v", round, err)
+		}
+		if errs := db.Verify(); len(errs) != 0 {
+			t.Fatalf("round %d: Verify: %v", round, errs)
+		}
+		if !checkContent(t, db, ref) && !checkContent(t, db, next) {
+			t.Fatalf("round %d: the content is neither the old nor the new version", round)
+		}
+
+		// and it keeps working
+		tx := db.Begin()
+		if _, err := randomTx(rng, tx, map[string]string{}); err != nil {
+			t.Fatalf("round %d: update: %v", round, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("round %d: Commit: %v", round, err)
+		}
+		if errs := db.Verify(); len(errs) != 0 {
+			t.Fatalf("round %d: Verify after reopen: %v", round, errs)
+		}
+	}
+}
+
+// a failed commit is rolled back and later commits are not affected
+func TestPagerFailedCommit(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := newFaultStore(rng)
+	db := &Pager{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	ref := map[string]string{}
+	failures := 0
+	for i := 0; i < 300; i++ {
+		if i%3 == 0 {
+			store.failAfter(1+rng.Intn(20), rng.Intn(2) == 0)
+		}
+		tx := db.Begin()
+		next, err := randomTx(rng, tx, ref)
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		err = tx.Commit()
+		if errors.Is(err, ErrFailed) {
+			// the master page may be half written
+			db = &Pager{Store: store.crash()}
+			if err := db.Open(); err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			store = db.Store.(*faultStore)
+			if checkContent(t, db, next) {
+				ref = next
+			}
+			continue
+		}
+		if err != nil {
+			failures++
+			continue
+		}
+		ref = next
+	}
+	if failures == 0 {
+		t.Fatalf("no commit failed")
+	}
+
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	if !checkContent(t, db, ref) {
+		t.Fatalf("the content does not match the committed updates")
+	}
+	db = &Pager{Store: store.crash()}
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !checkContent(t, db, ref) {
+		t.Fatalf("the content does not match after reopening")
+	}
+}
+
+// a torn master page write falls back to the previous slot
+func TestPagerTornMaster(t *testing.T) {
+	store := newFaultStore(rand.New(rand.NewSource(1)))
+	db := &Pager{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	db.Tree("tree").Set([]byte("key"), []byte("old"))
+	db.Tree("tree").Set([]byte("key"), []byte("new"))
+
+	// the writes, the sync, then the master page
+	tx := db.Begin()
+	tx.Tree("tree").Set([]byte("key"), []byte("torn"))
+	npages := len(db.page.temp) + len(db.page.updates)
+	store.failAfter(npages+2, true)
+	if err := tx.Commit(); !errors.Is(err, ErrFailed) {
+		t.Fatalf("expected ErrFailed, got %v", err)
+	}
+	if err := db.Tree("tree").Set([]byte("key"), nil); !errors.Is(err, ErrFailed) {
+		t.Fatalf("expected ErrFailed after a failed master page write, got %v", err)
+	}
+
+	// the torn slot is lost even if it reaches the disk
+	disk := store.crash()
+	maps.Copy(disk.durable, store.volatile)
+	db = &Pager{Store: disk}
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if val, _, _ := db.Tree("tree").Get([]byte("key")); string(val) != "new" {
+		t.Fatalf("expected the previous version, got %q", val)
+	}
+}
@@ -0,0 +1,175 @@
+package bplustree
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// a store backed by a file, pages are read and written with pread and
+// pwrite through an LRU cache of pages. unlike MmapStore, the memory use
+// is bounded by the cache size and I/O errors are returned instead of
+// killing the process with SIGBUS.
+type FileStore struct {
+	Path      string
+	ReadOnly  bool // shared lock, the file is not created and writes are rejected
+	CacheSize int  // the memory budget of the cache in bytes
+	fp        *os.File
+	pageSize  int
+	mu        sync.Mutex // protects the fields below
+	size      int64      // the file size
+	cache     struct {
+		pages map[uint64]*list.Element // of *cachedPage
+		lru   list.List                // the most recently used first
+		max   int                      // the number of pages in the budget
+	}
+}
+
+type cachedPage struct {
+	ptr  uint64
+	data []byte
+}
+
+func (s *FileStore) Open() (uint64, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if s.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(s.Path, flag, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("OpenFile: %w", err)
+	}
+	s.fp = fp
+	if err := LockFile(fp, s.ReadOnly); err != nil {
+		return 0, fmt.Errorf("%w: %s", err, s.Path)
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size()%BTREE_MIN_PAGE_SIZE != 0 {
+		return 0, errors.New("File size is not a multiple of page size.")
+	}
+	s.size = fi.Size()
+	s.setPageSize(BTREE_MIN_PAGE_SIZE) // until SetPageSize()
+	return uint64(s.size) / BTREE_MIN_PAGE_SIZE, nil
+}
+
+func (s *FileStore) SetPageSize(size int) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size%int64(size) != 0 {
+		return 0, errors.New("File size is not a multiple of page size.")
+	}
+	s.setPageSize(size)
+	return uint64(s.size / int64(size)), nil
+}
+
+// the cached pages of the old size are dropped
+func (s *FileStore) setPageSize(size int) {
+	s.pageSize = size
+	s.cache.pages = map[uint64]*list.Element{}
+	s.cache.lru.Init()
+	s.cache.max = max(s.CacheSize/size, 1)
+}
+
+func (s *FileStore) Close() error {
+	if s.fp == nil {
+		return nil
+	}
+	s.cache.pages = nil
+	s.cache.lru.Init()
+	return s.fp.Close()
+}
+
+func (s *FileStore) ReadPage(ptr uint64) ([]byte, error) {
+	s.mu.Lock()
+	if elem, ok := s.cache.pages[ptr]; ok {
+		s.cache.lru.MoveToFront(elem)
+		s.mu.Unlock()
+		return elem.Value.(*cachedPage).data, nil
+	}
+	size := s.size
+	s.mu.Unlock()
+
+	offset := int64(ptr) * int64(s.pageSize)
+	if offset+int64(s.pageSize) > size {
+		return nil, fmt.Errorf("page %d is out of the file", ptr)
+	}
+	data := make([]byte, s.pageSize)
+	if _, err := s.fp.ReadAt(data, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("pread: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cacheAdd(ptr, data)
+	return data, nil
+}
+
+// add or replace a page, the least recently used page is evicted.
+// a replaced page is not modified, readers may still hold it.
+func (s *FileStore) cacheAdd(ptr uint64, data []byte) {
+	if elem, ok := s.cache.pages[ptr]; ok {
+		elem.Value.(*cachedPage).data = data
+		s.cache.lru.MoveToFront(elem)
+		return
+	}
+	s.cache.pages[ptr] = s.cache.lru.PushFront(&cachedPage{ptr: ptr, data: data})
+	for s.cache.lru.Len() > s.cache.max {
+		oldest := s.cache.lru.Remove(s.cache.lru.Back()).(*cachedPage)
+		delete(s.cache.pages, oldest.ptr)
+	}
+}
+
+func (s *FileStore) WritePage(ptr uint64, page []byte) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	assert(len(page) <= s.pageSize)
+	// a new copy, readers may still hold the old one
+	data := make([]byte, s.pageSize)
+	copy(data, page)
+	offset := int64(ptr) * int64(s.pageSize)
+	if _, err := s.fp.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("pwrite: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = max(s.size, offset+int64(s.pageSize))
+	s.cacheAdd(ptr, data)
+	return nil
+}
+
+func (s *FileStore) WriteMaster(offset int, data []byte) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	if _, err := s.fp.WriteAt(data, int64(offset)); err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a new file is 1 page with the master page
+	s.size = max(s.size, int64(s.pageSize))
+	if elem, ok := s.cache.pages[0]; ok {
+		s.cache.lru.Remove(elem)
+		delete(s.cache.pages, 0)
+	}
+	return nil
+}
+
+func (s *FileStore) Sync() error {
+	if err := s.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package bplustree
+
+import "encoding/binary"
+
+// ------------------------------------------------
+// free list node layout
+//  type      unused    next      pointers...
+// | 2 bytes | 2 bytes | 8 bytes | 8 bytes * freeListCap() |
+// ------------------------------------------------
+// the free list is a FIFO queue of unused page numbers.
+// pages are pushed to the tail and popped from the head,
+// the position of an item is given by its sequence number.
+
+const BNODE_FREE = 3 // free list nodes
+
+const FREE_LIST_HEADER = 4 + 8
+
+// the number of items in a list node
+func freeListCap(pageSize int) int {
+	return (pageSize - BTREE_PAGE_TRAILER - FREE_LIST_HEADER) / 8
+}
+
+type LNode []byte
+
+func newLNode(pageSize int) LNode {
+	node := LNode(make([]byte, pageSize))
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_FREE)
+	return node
+}
+
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[4:])
+}
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[4:], next)
+}
+func (node LNode) getPtr(idx int) uint64 {
+	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER+8*idx:])
+}
+func (node LNode) setPtr(idx int, ptr uint64) {
+	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER+8*idx:], ptr)
+}
+
+type FreeList struct {
+	// callbacks for managing on-disk pages
+	get func(uint64) []byte // read a page
+	new func([]byte) uint64 // append a new page
+	set func(uint64) []byte // update an existing page
+	// the size of the list nodes
+	pageSize int
+	// persisted data in the master page
+	headPage uint64 // pointer to the list node of the next item to pop
+	headSeq  uint64 // monotonic sequence number of the next item to pop
+	tailPage uint64 // pointer to the list node of the next slot to push
+	tailSeq  uint64 // monotonic sequence number of the next slot to push
+	// in-memory states
+	maxSeq uint64 // saved `tailSeq`, items pushed after it can't be reused yet
+}
+
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(freeListCap(fl.pageSize)))
+}
+
+// number of items in the list
+func (fl *FreeList) Total() int {
+	return int(fl.tailSeq - fl.headSeq)
+}
+
+// make the items pushed before `maxSeq` available to PopHead().
+// pages freed by the current update, or freed after a snapshot
+// that is still being read, must not be reused.
+func (fl *FreeList) SetMaxSeq(maxSeq uint64) {
+	assert(fl.headSeq <= maxSeq && maxSeq <= fl.tailSeq)
+	fl.maxSeq = maxSeq
+}
+
+// get 1 item from the list head. returns 0 on failure.
+func (fl *FreeList) PopHead() uint64 {
+	ptr, head := flPop(fl)
+	if head != 0 {
+		// the empty head node is recycled
+		fl.PushTail(head)
+	}
+	return ptr
+}
+
+// remove 1 item from the head node, and remove the head node if empty.
+func flPop(fl *FreeList) (ptr uint64, head uint64) {
+	if fl.headSeq == fl.maxSeq {
+		return 0, 0 // cannot advance
+	}
+	node := LNode(fl.get(fl.headPage))
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
+	fl.headSeq++
+	// move to the next node if the head node is empty
+	if fl.seq2idx(fl.headSeq) == 0 {
+		head, fl.headPage = fl.headPage, node.getNext()
+		assert(fl.headPage != 0)
+	}
+	return
+}
+
+// add 1 item to the tail
+func (fl *FreeList) PushTail(ptr uint64) {
+	if fl.tailPage == 0 {
+		// the first list node
+		fl.tailPage = fl.new(newLNode(fl.pageSize))
+		fl.headPage = fl.tailPage
+	}
+	// add it to the tail node
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
+	fl.tailSeq++
+	// add a new tail node if it's full (the list is never empty)
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		// try to reuse from the list head
+		next, head := flPop(fl) // may remove the head node
+		if next == 0 {
+			// or allocate a new node by appending
+			next = fl.new(newLNode(fl.pageSize))
+		} else {
+			copy(fl.set(next), newLNode(fl.pageSize))
+		}
+		// link to the new tail node
+		LNode(fl.set(fl.tailPage)).setNext(next)
+		fl.tailPage = next
+		// also add the head node if it's removed
+		if head != 0 {
+			LNode(fl.set(fl.tailPage)).setPtr(0, head)
+			fl.tailSeq++
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package bplustree
+
+import "bytes"
+
+// B-tree iterator, a path from the root to a leaf
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.Root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := NodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// find the closest position that is greater or equal to the input key
+func (tree *BTree) SeekGE(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if len(iter.path) == 0 {
+		return iter
+	}
+	if !iter.Valid() || bytes.Compare(iter.Key(), key) < 0 {
+		iter.Next()
+	}
+	return iter
+}
+
+// the iterator points to a key.
+// false before the first key (the dummy key) and past the last key.
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return false
+	}
+	// the dummy key is empty, real keys are not
+	return len(iter.path[last].GetKey(iter.pos[last])) != 0
+}
+
+// get the current KV pair.
+// the returned slices may refer to the page data and must not be modified.
+func (iter *BIter) Key() []byte {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	return iter.path[last].GetKey(iter.pos[last])
+}
+
+func (iter *BIter) Val() []byte {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	return treeGetVal(iter.tree, iter.path[last], iter.pos[last])
+}
+
+// moving forward
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return // already past the last key
+	}
+	if !iterNext(iter, last) {
+		iter.pos[last] = iter.path[last].nkeys() // past the last key
+	}
+}
+
+// returns false at the last key, the path is not changed then.
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // the last kid of the last node
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		node := iter.path[level]
+		kid := iter.tree.get(node.getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+// moving backward
+func (iter *BIter) Prev() {
+	if len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		// back from past the last key
+		iter.pos[last] = iter.path[last].nkeys() - 1
+		return
+	}
+	if !iter.Valid() {
+		return // already at the dummy key
+	}
+	iterPrev(iter, last)
+}
+
+func iterPrev(iter *BIter, level int) {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level > 0 {
+		iterPrev(iter, level-1) // move to a sibling node
+	} else {
+		panic("unreachable") // the dummy key stops the iteration
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		node := iter.path[level]
+		kid := iter.tree.get(node.getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+}
@@ -0,0 +1,156 @@
+package bplustree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestBIterSeek(t *testing.T) {
+	c := newC()
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("key%05d", i*2), fmt.Sprintf("val%d", i*2))
+	}
+
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		even := i - i%2
+
+		iter := c.tree.SeekLE(key)
+		if !iter.Valid() || string(iter.Key()) != fmt.Sprintf("key%05d", even) {
+			t.Fatalf("SeekLE(%s): got %q", key, iter.Key())
+		}
+		if string(iter.Val()) != fmt.Sprintf("val%d", even) {
+			t.Fatalf("SeekLE(%s): got val %q", key, iter.Val())
+		}
+
+		iter = c.tree.SeekGE(key)
+		if i == 9999 {
+			if iter.Valid() {
+				t.Fatalf("SeekGE(%s): expected past the last key, got %q", key, iter.Key())
+			}
+			continue
+		}
+		next := i + i%2
+		if !iter.Valid() || string(iter.Key()) != fmt.Sprintf("key%05d", next) {
+			t.Fatalf("SeekGE(%s): got %q", key, iter.Key())
+		}
+	}
+
+	if iter := c.tree.SeekLE([]byte("a")); iter.Valid() {
+		t.Fatalf("SeekLE before the first key: expected invalid, got %q", iter.Key())
+	}
+	if iter := c.tree.SeekGE([]byte("a")); !iter.Valid() || string(iter.Key()) != "key00000" {
+		t.Fatalf("SeekGE before the first key: expected key00000")
+	}
+}
+
+func TestBIterNextPrev(t *testing.T) {
+	c := newC()
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("k%d", i), "v")
+	}
+	for i := 0; i < 5000; i += 3 {
+		c.del(fmt.Sprintf("k%d", i))
+	}
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// forward
+	iter := c.tree.SeekGE([]byte(keys[0]))
+	for _, k := range keys {
+		if !iter.Valid() || string(iter.Key()) != k {
+			t.Fatalf("Next: expected %q", k)
+		}
+		iter.Next()
+	}
+	if iter.Valid() {
+		t.Fatalf("Next: expected past the last key")
+	}
+	iter.Next()
+	if iter.Valid() {
+		t.Fatalf("Next: expected to stay past the last key")
+	}
+
+	// and backward
+	for i := len(keys) - 1; i >= 0; i-- {
+		iter.Prev()
+		if !iter.Valid() || string(iter.Key()) != keys[i] {
+			t.Fatalf("Prev: expected %q", keys[i])
+		}
+	}
+	iter.Prev()
+	if iter.Valid() {
+		t.Fatalf("Prev: expected before the first key")
+	}
+	iter.Next()
+	if !iter.Valid() || string(iter.Key()) != keys[0] {
+		t.Fatalf("Next: expected %q", keys[0])
+	}
+}
+
+// more than 2 levels, the iterator stops at the last key
+func TestBIterDeepTree(t *testing.T) {
+	c := newC()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("%0300d", i), "v")
+	}
+	iter := c.tree.SeekGE([]byte("0"))
+	if len(iter.path) < 3 {
+		t.Fatalf("expected at least 3 levels, got %d", len(iter.path))
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+		if count > 1000 {
+			t.Fatalf("Next: iterated past the last key")
+		}
+	}
+	if count != 1000 {
+		t.Fatalf("Next: %d keys, expected 1000", count)
+	}
+	iter.Prev()
+	if !iter.Valid() || string(iter.Key()) != fmt.Sprintf("%0300d", 999) {
+		t.Fatalf("Prev: expected the last key")
+	}
+}
+
+func TestBIterEmptyTree(t *testing.T) {
+	c := newC()
+	iter := c.tree.SeekGE([]byte("a"))
+	iter.Next()
+	iter.Prev()
+	if iter.Valid() {
+		t.Fatalf("expected an invalid iterator on an empty tree")
+	}
+}
+
+func TestPagerScan(t *testing.T) {
+	db := openTestPager(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+
+	got := []string{}
+	db.Scan([]byte("key10"), []byte("key20"), func(key []byte, val []byte) bool {
+		got = append(got, string(val))
+		return true
+	})
+	if len(got) != 10 || got[0] != "10" || got[9] != "19" {
+		t.Fatalf("Scan [key10, key20): got %v", got)
+	}
+
+	got = got[:0]
+	db.Scan([]byte("key95"), nil, func(key []byte, val []byte) bool {
+		got = append(got, string(val))
+		return len(got) < 3
+	})
+	if len(got) != 3 || got[0] != "95" || got[2] != "97" {
+		t.Fatalf("Scan [key95, ...) stopped after 3: got %v", got)
+	}
+}
@@ -0,0 +1,222 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var ErrLocked = errors.New("database is locked")
+
+// a store backed by a file, pages are read and written via mmap.
+// the file is locked while it's open, by 1 writer or by shared readers.
+type MmapStore struct {
+	Path     string
+	ReadOnly bool // shared lock, the file is not created and writes are rejected
+	fp       *os.File
+	pageSize int
+	mu       sync.RWMutex // protects `mmap.chunks` against extensions
+	mmap     struct {
+		file   int      // file size, can be larger than the database size
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+}
+
+func mmapInit(fp *os.File, prot int) (int, []byte, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, nil, fmt.Errorf("stat: %w", err)
+	}
+
+	if fi.Size()%BTREE_MIN_PAGE_SIZE != 0 {
+		return 0, nil, errors.New("File size is not a multiple of page size.")
+	}
+
+	mmapSize := 64 << 20
+	assert(mmapSize%BTREE_MAX_PAGE_SIZE == 0)
+	for mmapSize < int(fi.Size()) {
+		mmapSize *= 2
+	}
+	// mmapSize can be larger than the file
+
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return 0, nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	return int(fi.Size()), chunk, nil
+}
+
+// extend the mmap by adding new mappings.
+func extendMmap(s *MmapStore, npages int) error {
+	if s.mmap.total >= npages*s.pageSize {
+		return nil
+	}
+
+	// double the address space
+	chunk, err := syscall.Mmap(
+		int(s.fp.Fd()), int64(s.mmap.total), s.mmap.total,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	s.mmap.total += s.mmap.total
+	// existing mappings are never moved, readers can keep using them
+	s.mu.Lock()
+	s.mmap.chunks = append(s.mmap.chunks, chunk)
+	s.mu.Unlock()
+	return nil
+}
+
+func extendFile(s *MmapStore, npages int) error {
+	filePages := s.mmap.file / s.pageSize
+	if filePages >= npages {
+		return nil
+	}
+
+	for filePages < npages {
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+
+	fileSize := filePages * s.pageSize
+	// err := syscall.Fallocate(int(s.fp.Fd()), 0, 0, int64(fileSize))
+	// if err != nil {
+	// 	return fmt.Errorf("fallocate: %w", err)
+	// }
+	err := s.fp.Truncate(int64(fileSize))
+	if err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	s.mmap.file = fileSize
+	return nil
+}
+
+// an advisory lock on the file, it's released by closing the file.
+// fails with ErrLocked instead of waiting.
+func LockFile(fp *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("flock: %w", err)
+	}
+	return nil
+}
+
+func (s *MmapStore) Open() (uint64, error) {
+	// open or create the DB file
+	flag, prot := os.O_RDWR|os.O_CREATE, syscall.PROT_READ|syscall.PROT_WRITE
+	if s.ReadOnly {
+		flag, prot = os.O_RDONLY, syscall.PROT_READ
+	}
+	fp, err := os.OpenFile(s.Path, flag, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("OpenFile: %w", err)
+	}
+	s.fp = fp
+	if err := LockFile(fp, s.ReadOnly); err != nil {
+		return 0, fmt.Errorf("%w: %s", err, s.Path)
+	}
+
+	// create the initial mmap
+	sz, chunk, err := mmapInit(s.fp, prot)
+	if err != nil {
+		return 0, err
+	}
+	s.mmap.file = sz
+	s.mmap.total = len(chunk)
+	s.mmap.chunks = [][]byte{chunk}
+	s.pageSize = BTREE_MIN_PAGE_SIZE // until SetPageSize()
+	return uint64(sz / s.pageSize), nil
+}
+
+func (s *MmapStore) SetPageSize(size int) (uint64, error) {
+	if s.mmap.file%size != 0 {
+		return 0, errors.New("File size is not a multiple of page size.")
+	}
+	s.pageSize = size
+	return uint64(s.mmap.file / size), nil
+}
+
+func (s *MmapStore) Close() error {
+	for _, chunk := range s.mmap.chunks {
+		err := syscall.Munmap(chunk)
+		assert(err == nil)
+	}
+	s.mmap.chunks = nil
+	if s.fp == nil {
+		return nil
+	}
+	return s.fp.Close()
+}
+
+func (s *MmapStore) ReadPage(ptr uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := uint64(0)
+	for _, chunk := range s.mmap.chunks {
+		size := uint64(s.pageSize)
+		end := start + uint64(len(chunk))/size
+		if ptr < end {
+			offset := size * (ptr - start)
+			return chunk[offset : offset+size], nil
+		}
+		start = end
+	}
+	return nil, fmt.Errorf("page %d is out of the mmap", ptr)
+}
+
+func (s *MmapStore) WritePage(ptr uint64, page []byte) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	// extend the file & mmap if needed
+	if err := extendFile(s, int(ptr)+1); err != nil {
+		return err
+	}
+	if err := extendMmap(s, int(ptr)+1); err != nil {
+		return err
+	}
+	dst, err := s.ReadPage(ptr)
+	if err != nil {
+		return err
+	}
+	n := copy(dst, page)
+	clear(dst[n:])
+	return nil
+}
+
+func (s *MmapStore) WriteMaster(offset int, data []byte) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	// NOTE: Updating the page via mmap is not atomic.
+	//       Use the `pwrite()` syscall instead.
+	_, err := s.fp.WriteAt(data, int64(offset))
+	if err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+	return nil
+}
+
+func (s *MmapStore) Sync() error {
+	if err := s.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package bplustree
+
+import "encoding/binary"
+
+// ------------------------------------------------
+// values larger than treeSizes.maxVal are stored in a chain of
+// overflow pages, the leaf keeps a reference to the chain instead.
+// the reference is flagged by the top bit of the value length.
+//
+// value reference layout
+//  total len   first page
+// | 8 bytes  | 8 bytes   |
+// ------------------------------------------------
+// overflow page layout
+//  type      unused    next      data...
+// | 2 bytes | 2 bytes | 8 bytes | up to treeSizes.overflowCap bytes |
+// ------------------------------------------------
+
+const BNODE_OVERFLOW = 4 // overflow pages of large values
+
+const VAL_OVERFLOW = 0x8000 // flag in the value length
+const VAL_LEN_MASK = VAL_OVERFLOW - 1
+
+const OVERFLOW_HEADER = 4 + 8
+const OVERFLOW_REF_SIZE = 16
+
+func init() {
+	assert(BTREE_VAL_MAX <= VAL_LEN_MASK)
+	assert(OVERFLOW_REF_SIZE <= BTREE_MAX_VAL_SIZE)
+}
+
+// write a large value to new overflow pages, returns the reference to it.
+func overflowStore(tree *BTree, val []byte) []byte {
+	// written backwards so each page can link to the next one
+	next := uint64(0)
+	nchunks := int(tree.size.overflowPages(uint64(len(val))))
+	for i := nchunks - 1; i >= 0; i-- {
+		n := tree.size.overflowCap
+		chunk := val[i*n : min((i+1)*n, len(val))]
+		page := BNode{Data: make([]byte, tree.size.page)}
+		page.setHeader(BNODE_OVERFLOW, 0)
+		binary.LittleEndian.PutUint64(page.Data[4:], next)
+		copy(page.Data[OVERFLOW_HEADER:], chunk)
+		next = tree.new(page)
+	}
+
+	ref := make([]byte, OVERFLOW_REF_SIZE)
+	binary.LittleEndian.PutUint64(ref[0:], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[8:], next)
+	return ref
+}
+
+func overflowRef(ref []byte) (size uint64, ptr uint64) {
+	assert(len(ref) == OVERFLOW_REF_SIZE)
+	return binary.LittleEndian.Uint64(ref[0:]), binary.LittleEndian.Uint64(ref[8:])
+}
+
+// read a large value from its overflow pages
+func overflowLoad(tree *BTree, ref []byte) []byte {
+	size, ptr := overflowRef(ref)
+	val := make([]byte, 0, size)
+	for uint64(len(val)) < size {
+		page := tree.get(ptr)
+		if page.btype() != BNODE_OVERFLOW {
+			panic(&PageError{Ptr: ptr, Msg: "not an overflow page"})
+		}
+		n := min(size-uint64(len(val)), uint64(tree.size.overflowCap))
+		val = append(val, page.Data[OVERFLOW_HEADER:][:n]...)
+		ptr = binary.LittleEndian.Uint64(page.Data[4:])
+	}
+	return val
+}
+
+// deallocate the overflow pages of a large value
+func overflowFree(tree *BTree, ref []byte) {
+	size, ptr := overflowRef(ref)
+	for npages := tree.size.overflowPages(size); npages > 0; npages-- {
+		next := binary.LittleEndian.Uint64(tree.get(ptr).Data[4:])
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+// the number of overflow pages of a large value
+func (s treeSizes) overflowPages(size uint64) uint64 {
+	n := uint64(s.overflowCap)
+	return (size + n - 1) / n
+}
+
+// the value of a leaf KV, loaded from overflow pages if needed
+func treeGetVal(tree *BTree, node BNode, idx uint16) []byte {
+	if node.valOverflow(idx) {
+		return overflowLoad(tree, node.GetVal(idx))
+	}
+	return node.GetVal(idx)
+}
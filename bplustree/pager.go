@@ -5,196 +5,404 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
-	"syscall"
+	"hash/crc32"
+	"maps"
+	"sync"
 )
 
 const DB_SIG = "winnie"
 
+// ------------------------------------------------
+// master page slot layout
+//  sig        root      used      free list head, tail     flags     checksum   counter   page size   catalog
+// | 16 bytes | 8 bytes | 8 bytes | 8 bytes * 4            | 8 bytes | 4 bytes | 8 bytes | 4 bytes   | ...
+// ------------------------------------------------
+// the master page has 2 slots of half the smallest page, each commit
+// writes the other slot with the next counter. the newest intact slot
+// is used. the slots are at the same place for any page size, so the
+// page size is read from them.
+
+const MASTER_SIZE = 76
+const MASTER_SLOT_SIZE = BTREE_MIN_PAGE_SIZE / 2
+
+const (
+	MASTER_FLAG_CHECKSUM  = 1 // pages end with a checksum of their content
+	MASTER_FLAG_CATALOG   = 2 // named trees follow the fixed part
+	MASTER_FLAG_SLOTS     = 4 // the commit counter follows the fixed part
+	MASTER_FLAG_PAGE_SIZE = 8 // not BTREE_PAGE_SIZE, the page size follows the counter
+)
+
+// the Pager keeps the tree, the free list and the master page on top of
+// a PageStore, which is a file unless set otherwise.
 type Pager struct {
-	Path string
-	fp   *os.File
-	tree BTree
-	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
-	page struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
+	Path      string            // the file path, or MEMORY_PATH
+	Store     PageStore         // optional, overrides Path
+	ReadOnly  bool              // updates fail with ErrReadOnly, the file is not created
+	PageSize  int               // of a new file, 0 for BTREE_PAGE_SIZE. existing files must match
+	CacheSize int               // > 0 for pread/pwrite with a page cache of this many bytes instead of mmap
+	tree      BTree             // the default tree
+	roots     map[string]uint64 // the named trees
+	free      FreeList
+	checksum  bool   // verify page checksums on read, false for older files
+	failed    error  // no more updates after a failed master page write
+	seq       uint64 // the commit counter of the master page
+	page      struct {
+		flushed uint64            // database size in number of pages
+		temp    [][]byte          // newly appended pages
+		updates map[uint64][]byte // reused pages and in-place free list updates
 	}
+	// concurrency control
+	writer  sync.Mutex // serializes write transactions
+	mu      sync.Mutex // protects the fields below
+	version uint64     // incremented by each commit
+	snap    struct {
+		root    uint64            // the committed root
+		flushed uint64            // the committed database size
+		tailSeq uint64            // the committed free list tail
+		roots   map[string]uint64 // the committed named trees, never modified
+	}
+	readers map[*ReadTx]struct{} // active snapshots
 }
 
-func mmapInit(fp *os.File) (int, []byte, error) {
-	fi, err := fp.Stat()
-	if err != nil {
-		return 0, nil, fmt.Errorf("stat: %w", err)
+// callback for BTree, dereference a pointer.
+func (db *Pager) pageGet(ptr uint64) BNode {
+	if page, ok := db.page.updates[ptr]; ok {
+		return BNode{page} // reused or updated page
 	}
-
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
-		return 0, nil, errors.New("File size is not a multiple of page size.")
+	if ptr >= db.page.flushed && ptr-db.page.flushed < uint64(len(db.page.temp)) {
+		return BNode{db.page.temp[ptr-db.page.flushed]} // appended page
 	}
+	return pageGetChecked(db.Store, db.page.flushed, db.checksum, ptr)
+}
 
-	mmapSize := 64 << 20
-	assert(mmapSize%BTREE_PAGE_SIZE == 0)
-	for mmapSize < int(fi.Size()) {
-		mmapSize *= 2
+// read a flushed page and check it, panics with a *PageError if it's bad.
+func pageGetChecked(store PageStore, flushed uint64, checksum bool, ptr uint64) BNode {
+	if ptr == 0 || ptr >= flushed {
+		panic(&PageError{Ptr: ptr, Msg: "pointer out of bounds"})
+	}
+	node := pageGetStored(store, ptr)
+	if checksum && !pageChecksumOK(node.Data) {
+		panic(&PageError{Ptr: ptr, Msg: "checksum mismatch"})
 	}
-	// mmapSize can be larger than the file
+	return node
+}
 
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+// read a flushed page without checking it.
+func pageGetStored(store PageStore, ptr uint64) BNode {
+	page, err := store.ReadPage(ptr)
 	if err != nil {
-		return 0, nil, fmt.Errorf("mmap: %w", err)
+		panic(&PageError{Ptr: ptr, Msg: err.Error()})
 	}
+	return BNode{page}
+}
 
-	return int(fi.Size()), chunk, nil
+// bad pages panic in the tree, deferred by the reads to return the error.
+func recoverPageError(err *error) {
+	if r := recover(); r != nil {
+		perr, ok := r.(*PageError)
+		if !ok {
+			panic(r)
+		}
+		*err = perr
+	}
 }
 
-// extend the mmap by adding new mappings.
-func extendMmap(db *Pager, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
-		return nil
+// pad a page to the full size and seal it with a checksum.
+func pageSeal(page []byte, size int) []byte {
+	if len(page) < size {
+		page = append(page, make([]byte, size-len(page))...)
 	}
+	pageSetChecksum(page)
+	return page
+}
 
-	// double the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+// the content of a master page slot
+type master struct {
+	root     uint64
+	used     uint64
+	headPage uint64
+	headSeq  uint64
+	tailPage uint64
+	tailSeq  uint64
+	checksum bool
+	seq      uint64
+	pageSize int
+	roots    map[string]uint64
+}
+
+func masterParse(data []byte) (master, error) {
+	m := master{
+		root:     binary.LittleEndian.Uint64(data[16:]),
+		used:     binary.LittleEndian.Uint64(data[24:]),
+		headPage: binary.LittleEndian.Uint64(data[32:]),
+		headSeq:  binary.LittleEndian.Uint64(data[40:]),
+		tailPage: binary.LittleEndian.Uint64(data[48:]),
+		tailSeq:  binary.LittleEndian.Uint64(data[56:]),
+		pageSize: BTREE_PAGE_SIZE,
+		roots:    map[string]uint64{},
+	}
+	flags := binary.LittleEndian.Uint64(data[64:])
+
+	// verify the page
+	if !bytes.Equal([]byte(DB_SIG), data[:6]) {
+		return m, errors.New("Bad signature.")
+	}
+	size := MASTER_SIZE
+	if flags&MASTER_FLAG_SLOTS != 0 {
+		m.seq = binary.LittleEndian.Uint64(data[size:])
+		size += 8
+	}
+	if flags&MASTER_FLAG_PAGE_SIZE != 0 {
+		m.pageSize = int(binary.LittleEndian.Uint32(data[size:]))
+		size += 4
+	}
+	if flags&MASTER_FLAG_CATALOG != 0 {
+		roots, n, err := catalogDecode(data[size:])
+		if err != nil {
+			return m, err
+		}
+		m.roots = roots
+		size += n
+	}
+	// files created before page checksums have no flags
+	m.checksum = flags&MASTER_FLAG_CHECKSUM != 0
+	if m.checksum && binary.LittleEndian.Uint32(data[72:]) != masterChecksum(data[:size]) {
+		return m, errors.New("Bad master page checksum.")
 	}
+	if err := checkPageSize(m.pageSize); err != nil {
+		return m, err
+	}
+	return m, nil
+}
 
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+// check the pointers of the master page against the file size
+func masterCheck(m master, npages uint64) error {
+	bad := !(1 <= m.used && m.used <= npages)
+	bad = bad || !(0 <= m.root && m.root < m.used)
+	bad = bad || !(m.headPage < m.used && m.tailPage < m.used && m.headSeq <= m.tailSeq)
+	for _, ptr := range m.roots {
+		bad = bad || !(1 <= ptr && ptr < m.used)
+	}
+	if bad {
+		return errors.New("Bad master page.")
+	}
 	return nil
 }
 
-// callback for BTree, dereference a pointer.
-func (db *Pager) pageGet(ptr uint64) BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
-		}
-		start = end
+// a power of 2 in [BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE]
+func checkPageSize(size int) error {
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d", size)
 	}
-	panic("bad ptr")
+	return nil
 }
 
-func masterLoad(db *Pager) error {
-	if db.mmap.file == 0 {
+// read the master page and set the page size of the store
+func masterLoad(db *Pager, npages uint64) error {
+	if npages == 0 {
 		// empty file, the master page will be created on the first write.
+		pageSize := db.PageSize
+		if pageSize == 0 {
+			pageSize = BTREE_PAGE_SIZE
+		}
+		if err := checkPageSize(pageSize); err != nil {
+			return err
+		}
+		if _, err := db.Store.SetPageSize(pageSize); err != nil {
+			return err
+		}
+		db.PageSize = pageSize
 		db.page.flushed = 1 // reserved for the master page
+		db.checksum = true
+		db.roots = map[string]uint64{}
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-
-	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:6]) {
-		return errors.New("Bad signature.")
+	data, err := db.Store.ReadPage(0)
+	if err != nil {
+		return err
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(0 <= root && root < used)
-	if bad {
-		return errors.New("Bad master page.")
+	// the newest slot that is intact, the other one can be torn
+	m, err := masterParse(data[:MASTER_SLOT_SIZE])
+	if other, err1 := masterParse(data[MASTER_SLOT_SIZE : 2*MASTER_SLOT_SIZE]); err1 == nil {
+		if err != nil || other.seq > m.seq {
+			m, err = other, nil
+		}
 	}
-
-	db.tree.Root = root
-	db.page.flushed = used
+	if err != nil {
+		return err
+	}
+	if db.PageSize != 0 && db.PageSize != m.pageSize {
+		return fmt.Errorf("the page size is %d, not %d", m.pageSize, db.PageSize)
+	}
+	npages, err = db.Store.SetPageSize(m.pageSize)
+	if err != nil {
+		return err
+	}
+	if err := masterCheck(m, npages); err != nil {
+		return err
+	}
+	db.PageSize = m.pageSize
+
+	db.tree.Root = m.root
+	db.roots = m.roots
+	db.page.flushed = m.used
+	db.free.headPage, db.free.headSeq = m.headPage, m.headSeq
+	db.free.tailPage, db.free.tailSeq = m.tailPage, m.tailSeq
+	db.checksum = m.checksum
+	db.seq = m.seq
 	return nil
 }
 
-func masterStore(db *Pager) error {
-	var data [32]byte
+// encode a master page slot, the counter is only used with checksums.
+func masterEncode(m master) []byte {
+	data := make([]byte, MASTER_SIZE, MASTER_SLOT_SIZE)
 	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	// NOTE: Updating the page via mmap is not atomic.
-	//       Use the `pwrite()` syscall instead.
-	_, err := db.fp.WriteAt(data[:], 0)
-	if err != nil {
-		return fmt.Errorf("write master page: %w", err)
+	binary.LittleEndian.PutUint64(data[16:], m.root)
+	binary.LittleEndian.PutUint64(data[24:], m.used)
+	binary.LittleEndian.PutUint64(data[32:], m.headPage)
+	binary.LittleEndian.PutUint64(data[40:], m.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], m.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], m.tailSeq)
+	flags := uint64(0)
+	if m.checksum {
+		flags |= MASTER_FLAG_CHECKSUM | MASTER_FLAG_SLOTS
+		data = binary.LittleEndian.AppendUint64(data, m.seq)
 	}
-	return nil
+	// files of the default size can be read by older versions
+	if m.pageSize != BTREE_PAGE_SIZE {
+		assert(m.checksum)
+		flags |= MASTER_FLAG_PAGE_SIZE
+		data = binary.LittleEndian.AppendUint32(data, uint32(m.pageSize))
+	}
+	if len(m.roots) > 0 {
+		flags |= MASTER_FLAG_CATALOG
+		data = catalogEncode(data, m.roots)
+		assert(len(data) <= MASTER_SLOT_SIZE)
+	}
+	binary.LittleEndian.PutUint64(data[64:], flags)
+	if m.checksum {
+		binary.LittleEndian.PutUint32(data[72:], masterChecksum(data))
+	}
+	return data
+}
+
+func masterStore(db *Pager) error {
+	slot := 0
+	if db.checksum {
+		// alternate between the slots, the last one stays intact
+		// if this write is torn. older files only use the first slot.
+		db.seq++
+		slot = int(db.seq % 2)
+	}
+	data := masterEncode(master{
+		root:     db.tree.Root,
+		used:     db.page.flushed,
+		headPage: db.free.headPage,
+		headSeq:  db.free.headSeq,
+		tailPage: db.free.tailPage,
+		tailSeq:  db.free.tailSeq,
+		checksum: db.checksum,
+		seq:      db.seq,
+		pageSize: db.PageSize,
+		roots:    db.roots,
+	})
+	return db.Store.WriteMaster(slot*MASTER_SLOT_SIZE, data)
+}
+
+// the checksum covers the master page slot except itself
+func masterChecksum(data []byte) uint32 {
+	sum := crc32.Checksum(data[:72], crcTable)
+	return crc32.Update(sum, crcTable, data[MASTER_SIZE:])
 }
 
 // callback for BTree, allocate a new page.
 func (db *Pager) pageNew(node BNode) uint64 {
-	assert(len(node.Data) <= BTREE_PAGE_SIZE)
+	assert(len(node.Data) <= db.PageSize)
+	if ptr := db.free.PopHead(); ptr != 0 {
+		// reuse a page from the free list
+		db.page.updates[ptr] = node.Data
+		return ptr
+	}
+	return db.pageAppend(node.Data)
+}
+
+// callback for FreeList, allocate a new page at the end of the file.
+func (db *Pager) pageAppend(page []byte) uint64 {
+	assert(len(page) <= db.PageSize)
 	ptr := db.page.flushed + uint64(len(db.page.temp))
-	db.page.temp = append(db.page.temp, node.Data)
+	db.page.temp = append(db.page.temp, page)
 	return ptr
 }
 
-func extendFile(db *Pager, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
-	if filePages >= npages {
-		return nil
+// callback for FreeList, read a page.
+// the tail node is updated in place, a crash can leave it with a stale
+// checksum while the committed items in it are intact, so it's not checked.
+func (db *Pager) pageRead(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page
 	}
-
-	for filePages < npages {
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
-		}
-		filePages += inc
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed]
 	}
+	return pageGetStored(db.Store, ptr).Data
+}
 
-	fileSize := filePages * BTREE_PAGE_SIZE
-	// err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
-	// if err != nil {
-	// 	return fmt.Errorf("fallocate: %w", err)
-	// }
-	err := db.fp.Truncate(int64(fileSize))
-	if err != nil {
-		return fmt.Errorf("truncate: %w", err)
+// callback for FreeList, get a writable copy of an existing page.
+func (db *Pager) pageWrite(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page
 	}
-
-	db.mmap.file = fileSize
-	return nil
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed]
+	}
+	page := make([]byte, db.PageSize)
+	copy(page, pageGetStored(db.Store, ptr).Data)
+	db.page.updates[ptr] = page
+	return page
 }
 
-func (db *Pager) pageDel(uint64) {
-	// TODO
+// callback for BTree, deallocate a page.
+// the page is reused after the update that freed it is committed.
+func (db *Pager) pageDel(ptr uint64) {
+	db.free.PushTail(ptr)
 }
 
 func (db *Pager) Open() error {
-	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("OpenFile: %w", err)
+	if db.Store == nil && db.Path == MEMORY_PATH {
+		db.Store = NewMemoryStore()
+	} else if db.Store == nil && db.CacheSize > 0 {
+		db.Store = &FileStore{Path: db.Path, ReadOnly: db.ReadOnly, CacheSize: db.CacheSize}
+	} else if db.Store == nil {
+		db.Store = &MmapStore{Path: db.Path, ReadOnly: db.ReadOnly}
 	}
-	db.fp = fp
-
-	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
+	npages, err := db.Store.Open()
 	if err != nil {
 		goto fail
 	}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
 
 	// btree callbacks
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
+	// free list callbacks
+	db.free.get = db.pageRead
+	db.free.new = db.pageAppend
+	db.free.set = db.pageWrite
+	db.page.updates = map[uint64][]byte{}
 
 	// read the master page
-	err = masterLoad(db)
+	err = masterLoad(db, npages)
 	if err != nil {
 		goto fail
 	}
+	db.tree.size = newTreeSizes(db.PageSize)
+	db.free.pageSize = db.PageSize
+	db.snap.root = db.tree.Root
+	db.snap.flushed = db.page.flushed
+	db.snap.tailSeq = db.free.tailSeq
+	db.snap.roots = maps.Clone(db.roots)
+	db.readers = map[*ReadTx]struct{}{}
 
 	// done
 	return nil
@@ -205,27 +413,58 @@ fail:
 }
 
 func (db *Pager) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		assert(err == nil)
-	}
-	_ = db.fp.Close()
+	_ = db.Store.Close()
 }
 
-func (db *Pager) Get(val string) ([]byte, bool) {
+// look up a key in the committed tree.
+// a bad page is returned as a *PageError.
+func (db *Pager) Get(val string) ([]byte, bool, error) {
 	key := []byte(val)
-	return db.tree.Get(key)
+	rx := db.BeginRead()
+	defer rx.Done()
+	return rx.Get(key)
 }
 
+// insert or update a key in its own transaction
 func (db *Pager) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	tx := db.Begin()
+	if err := tx.Set(key, val); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// delete a key in its own transaction
+func (db *Pager) Del(key []byte) (bool, error) {
+	tx := db.Begin()
+	deleted, err := tx.Del(key)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
 }
 
-// func (db *Pager) Del(key []byte) (bool, error) {
-// 	deleted := db.tree.Delete(key)
-// 	return deleted, flushPages(db)
-// }
+// call fn for each key in [start, end) in order, a nil end scans to the last key.
+// the slices passed to fn are only valid during the call.
+// returning false from fn stops the scan, a bad page stops it with a *PageError.
+func (db *Pager) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	rx := db.BeginRead()
+	defer rx.Done()
+	return rx.Scan(start, end, fn)
+}
+
+func treeScan(tree *BTree, start []byte, end []byte, fn func(key []byte, val []byte) bool) {
+	for iter := tree.SeekGE(start); iter.Valid(); iter.Next() {
+		if end != nil && bytes.Compare(iter.Key(), end) >= 0 {
+			return
+		}
+		if !fn(iter.Key(), iter.Val()) {
+			return
+		}
+	}
+}
 
 func flushPages(db *Pager) error {
 	if err := writePages(db); err != nil {
@@ -235,37 +474,44 @@ func flushPages(db *Pager) error {
 }
 
 func writePages(db *Pager) error {
-	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + len(db.page.temp)
-	if err := extendFile(db, npages); err != nil {
-		return err
-	}
-	if err := extendMmap(db, npages); err != nil {
-		return err
-	}
-
-	// copy data to the file
+	// copy data to the store
 	for i, page := range db.page.temp {
 		ptr := db.page.flushed + uint64(i)
-		copy(db.pageGet(ptr).Data, page)
+		if err := db.Store.WritePage(ptr, pageSeal(page, db.PageSize)); err != nil {
+			return err
+		}
+	}
+	for ptr, page := range db.page.updates {
+		if err := db.Store.WritePage(ptr, pageSeal(page, db.PageSize)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func syncPages(db *Pager) error {
 	// flush data to the disk. must be done before updating the master page.
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if err := db.Store.Sync(); err != nil {
+		return err
 	}
 	db.page.flushed += uint64(len(db.page.temp))
 	db.page.temp = db.page.temp[:0]
+	db.page.updates = map[uint64][]byte{}
 
 	// update & flush the master page
 	if err := masterStore(db); err != nil {
-		return err
+		return masterFailed(db, err)
 	}
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if err := db.Store.Sync(); err != nil {
+		return masterFailed(db, err)
 	}
 	return nil
 }
+
+// the master page on disk can be either the old or the new one.
+// the pages of both versions must be kept until the database is reopened,
+// so no more updates are allowed.
+func masterFailed(db *Pager, err error) error {
+	db.failed = fmt.Errorf("%w: %w", ErrFailed, err)
+	return db.failed
+}
@@ -0,0 +1,298 @@
+package bplustree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestPager(t *testing.T, path string) *Pager {
+	db := &Pager{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return db
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return fi.Size()
+}
+
+func TestPagerSetGetDel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Set([]byte(key), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		deleted, err := db.Del([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || !deleted {
+			t.Fatalf("Del: %t, %v", deleted, err)
+		}
+	}
+	db.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+		if i%2 == 0 {
+			if ok {
+				t.Fatalf("key%d: expected deleted", i)
+			}
+			continue
+		}
+		if !ok || string(val) != fmt.Sprintf("val%d", i) {
+			t.Fatalf("key%d: expected val%d, got %q (%t)", i, i, val, ok)
+		}
+	}
+}
+
+func TestPagerReusesFreedPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Set([]byte(key), []byte("initial")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	used := db.page.flushed
+
+	// overwriting keys frees as many pages as it allocates,
+	// the file should not grow.
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if err := db.Set([]byte(key), []byte(fmt.Sprintf("round%d", round))); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	if db.page.flushed > used+8 {
+		t.Fatalf("database grew from %d to %d pages", used, db.page.flushed)
+	}
+	size := fileSize(t, path)
+	db.Close()
+
+	// the free list survives reopening
+	db = openTestPager(t, path)
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Set([]byte(key), []byte("reopened")); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if fileSize(t, path) != size {
+		t.Fatalf("file grew from %d to %d bytes", size, fileSize(t, path))
+	}
+	for i := 0; i < 2000; i++ {
+		val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+		if !ok || string(val) != "reopened" {
+			t.Fatalf("key%d: got %q (%t)", i, val, ok)
+		}
+	}
+}
+
+func TestPagerLargeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	large := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d,", i)), 10000)
+	}
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), large(i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 50; i += 2 {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("small"))
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	db.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+		expected := large(i)
+		if i%2 == 0 {
+			expected = []byte("small")
+		}
+		if !ok || !bytes.Equal(val, expected) {
+			t.Fatalf("key%d: got %d bytes, expected %d", i, len(val), len(expected))
+		}
+	}
+
+	// keys are not moved out of the node
+	if err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Set(nil, []byte("val")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("expected ErrEmptyKey, got %v", err)
+	}
+}
+
+func TestPagerLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+	db.Set([]byte("key"), []byte("val"))
+
+	// 1 writer at a time
+	other := &Pager{Path: path}
+	if err := other.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	reader := &Pager{Path: path, ReadOnly: true}
+	if err := reader.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked for a reader, got %v", err)
+	}
+	db.Close()
+
+	// or many readers
+	readers := []*Pager{}
+	for i := 0; i < 2; i++ {
+		reader := &Pager{Path: path, ReadOnly: true}
+		if err := reader.Open(); err != nil {
+			t.Fatalf("Open shared: %v", err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	if val, ok, _ := readers[1].Get("key"); !ok || string(val) != "val" {
+		t.Fatalf("Get: %q (%t)", val, ok)
+	}
+	if err := readers[0].Set([]byte("key"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := other.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked with readers, got %v", err)
+	}
+}
+
+func TestPagerReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &Pager{Path: path, ReadOnly: true}
+	if err := db.Open(); err == nil {
+		t.Fatalf("opened a missing file")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the file was created: %v", err)
+	}
+
+	db = openTestPager(t, path)
+	db.Tree("tree").Set([]byte("key"), []byte("val"))
+	db.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	db = &Pager{Path: path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if val, ok, _ := db.Tree("tree").Get([]byte("key")); !ok || string(val) != "val" {
+		t.Fatalf("Get: %q (%t)", val, ok)
+	}
+	if err := db.Tree("tree").Set([]byte("key"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := db.Tree("tree").Del([]byte("key")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	db.Close()
+
+	after, _ := os.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Fatalf("the file was modified")
+	}
+}
+
+func TestPagerPageSize(t *testing.T) {
+	for _, pageSize := range []int{8192, 65536} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		db := &Pager{Path: path, PageSize: pageSize}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		ref := map[string]string{}
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			val := fmt.Sprintf("%0*d", i%7*3000, i) // inline and overflow values
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			ref[key] = val
+		}
+		for i := 0; i < 3000; i += 3 {
+			db.Del([]byte(fmt.Sprintf("key%d", i)))
+			delete(ref, fmt.Sprintf("key%d", i))
+		}
+		db.Tree("names").Set([]byte("winnie"), []byte("stella"))
+		buf := bytes.Buffer{}
+		if err := db.Backup(&buf); err != nil {
+			t.Fatalf("Backup: %v", err)
+		}
+		db.Close()
+		if fileSize(t, path)%int64(pageSize) != 0 {
+			t.Fatalf("the file size is not a multiple of %d", pageSize)
+		}
+
+		// the page size is read from the file
+		copyPath := filepath.Join(dir, "copy.db")
+		if err := os.WriteFile(copyPath, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		for _, path := range []string{path, copyPath} {
+			db = openTestPager(t, path)
+			if db.PageSize != pageSize {
+				t.Fatalf("expected the page size %d, got %d", pageSize, db.PageSize)
+			}
+			if errs := db.Verify(); len(errs) != 0 {
+				t.Fatalf("Verify: %v", errs)
+			}
+			if !checkContent(t, db, ref) {
+				t.Fatalf("page size %d: the content does not match", pageSize)
+			}
+			if val, _, _ := db.Tree("names").Get([]byte("winnie")); string(val) != "stella" {
+				t.Fatalf("named tree: %q", val)
+			}
+			db.Close()
+		}
+
+		db = &Pager{Path: path, PageSize: BTREE_PAGE_SIZE}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("expected a page size mismatch")
+		}
+	}
+
+	for _, pageSize := range []int{2048, 6000, 2 * BTREE_MAX_PAGE_SIZE} {
+		db := &Pager{Path: MEMORY_PATH, PageSize: pageSize}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("expected a bad page size: %d", pageSize)
+		}
+	}
+}
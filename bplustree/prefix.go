@@ -0,0 +1,148 @@
+package bplustree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ------------------------------------------------
+// leaves are written in the prefix format. the common prefix of the keys
+// is stored once and each key keeps only the rest of it. leaves have no
+// pointers, so they are left out too.
+//
+// prefix leaf layout
+//  type      format   nkeys     prefix len   prefix   offsets      KVs
+// | 1 byte | 1 byte | 2 bytes | 2 bytes    | ...    | nkeys * 2B | ... |
+//
+// KV layout, the same as the plain format but with the key suffix
+//  klen      vlen      key suffix   val
+// | 2 bytes | 2 bytes | ...        | ... |
+// ------------------------------------------------
+// nodes in memory are always plain, see nodeEncode().
+// plain nodes have the format 0, so files written before are still read.
+
+const (
+	BNODE_FORMAT_PLAIN  = 0 // keys in full and pointers
+	BNODE_FORMAT_PREFIX = 1 // leaves only, see above
+)
+
+// the format is the high byte of the type
+func (node BNode) format() uint8 {
+	return node.Data[1]
+}
+
+// the common prefix of the keys of a prefix leaf
+func (node BNode) prefix() []byte {
+	assert(node.format() == BNODE_FORMAT_PREFIX)
+	plen := binary.LittleEndian.Uint16(node.Data[HEADER:])
+	return node.Data[HEADER+2:][:plen]
+}
+
+// the length of the common prefix. the keys of a node are sorted,
+// so the prefix of the first and the last key is shared by all.
+func commonPrefix(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// the key as stored in the node, without the prefix
+func (node BNode) keySuffix(idx uint16) []byte {
+	assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node.Data[pos:])
+	return node.Data[pos+4:][:klen]
+}
+
+// compare a key of the node with a key, without copying a prefixed key.
+func (node BNode) compareKey(idx uint16, key []byte) int {
+	if node.format() != BNODE_FORMAT_PREFIX {
+		return bytes.Compare(node.keySuffix(idx), key)
+	}
+	prefix := node.prefix()
+	n := min(len(prefix), len(key))
+	if cmp := bytes.Compare(prefix, key[:n]); cmp != 0 {
+		return cmp
+	}
+	if n < len(prefix) {
+		return +1 // the key is a prefix of the prefix
+	}
+	return bytes.Compare(node.keySuffix(idx), key[n:])
+}
+
+// the size of the KVs [from, to) of a plain node when written to a page.
+func nodeRangeSize(node BNode, from uint16, to uint16) int {
+	assert(node.format() == BNODE_FORMAT_PLAIN)
+	n := int(to - from)
+	kvs := int(node.getOffset(to) - node.getOffset(from))
+	if node.btype() != BNODE_LEAF {
+		return HEADER + 8*n + 2*n + kvs
+	}
+	plen := 0
+	if n > 0 {
+		plen = commonPrefix(node.GetKey(from), node.GetKey(to-1))
+	}
+	return HEADER + 2 + plen + 2*n + kvs - n*plen
+}
+
+func nodeSize(node BNode) int {
+	return nodeRangeSize(node, 0, node.nkeys())
+}
+
+// the KVs [from, to) of a plain node fit in a page. the plain size is
+// limited too, the positions of plain nodes are 16 bits and this leaves
+// room for an insert, see treeSizes.
+func nodeRangeFits(size treeSizes, node BNode, from uint16, to uint16) bool {
+	n := int(to - from)
+	plain := HEADER + 8*n + 2*n + int(node.getOffset(to)-node.getOffset(from))
+	return plain <= size.plainMax && nodeRangeSize(node, from, to) <= size.node
+}
+
+func nodeFits(size treeSizes, node BNode) bool {
+	return nodeRangeFits(size, node, 0, node.nkeys())
+}
+
+// the size of a node in the plain format, for the buffers of updates.
+func (node BNode) plainSize() int {
+	size := int(node.Nbytes())
+	if node.format() == BNODE_FORMAT_PREFIX {
+		n, plen := int(node.nkeys()), len(node.prefix())
+		size += 8*n + n*plen - 2 - plen
+	}
+	return size
+}
+
+// convert a plain node to its page format
+func nodeEncode(size treeSizes, node BNode) BNode {
+	assert(node.format() == BNODE_FORMAT_PLAIN)
+	assert(nodeFits(size, node))
+	if node.btype() != BNODE_LEAF {
+		if len(node.Data) >= size.page {
+			return BNode{node.Data[:size.page]}
+		}
+		page := BNode{make([]byte, size.page)}
+		copy(page.Data, node.Data[:node.Nbytes()])
+		return page
+	}
+
+	nkeys := node.nkeys()
+	plen := 0
+	if nkeys > 0 {
+		plen = commonPrefix(node.GetKey(0), node.GetKey(nkeys-1))
+	}
+	page := BNode{make([]byte, size.page)}
+	page.setHeader(BNODE_LEAF|BNODE_FORMAT_PREFIX<<8, nkeys)
+	binary.LittleEndian.PutUint16(page.Data[HEADER:], uint16(plen))
+	if nkeys > 0 {
+		copy(page.Data[HEADER+2:], node.GetKey(0)[:plen])
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		nodeAppendKV(page, i, 0, node.GetKey(i)[plen:], node.GetVal(i))
+		if node.valOverflow(i) {
+			page.setValOverflow(i)
+		}
+	}
+	return page
+}
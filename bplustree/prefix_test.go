@@ -0,0 +1,119 @@
+package bplustree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// count the leaves and check their format
+func countLeaves(t *testing.T, c *C, ptr uint64) int {
+	node := c.tree.get(ptr)
+	if node.btype() == BNODE_LEAF {
+		if node.format() != BNODE_FORMAT_PREFIX {
+			t.Fatalf("leaf %d: expected the prefix format, got %d", ptr, node.format())
+		}
+		return 1
+	}
+	if node.format() != BNODE_FORMAT_PLAIN {
+		t.Fatalf("node %d: expected the plain format, got %d", ptr, node.format())
+	}
+	total := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		total += countLeaves(t, c, node.getPtr(i))
+	}
+	return total
+}
+
+func TestPrefixLeaf(t *testing.T) {
+	c := newC()
+	plain := 0
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("idx:users:email:%08d", i)
+		c.add(key, "12345678")
+		plain += 8 + 2 + 4 + len(key) + 8
+	}
+	c.verify(t)
+
+	// the shared prefix is stored once per leaf
+	leaves := countLeaves(t, c, c.tree.Root)
+	if limit := plain / BTREE_NODE_SIZE; leaves >= limit {
+		t.Fatalf("expected fewer than %d leaves, got %d", limit, leaves)
+	}
+	for k, v := range c.ref {
+		got, ok := c.tree.Get([]byte(k))
+		if !ok || string(got) != v {
+			t.Fatalf("Get(%q): expected %q, got %q (%t)", k, v, got, ok)
+		}
+	}
+	for _, key := range []string{"idx:users:email:", "idx:users:email:1", "idx:users:email:000000000", "idx:z"} {
+		if _, ok := c.tree.Get([]byte(key)); ok {
+			t.Fatalf("Get(%q): expected not found", key)
+		}
+	}
+}
+
+func TestPrefixRandomOps(t *testing.T) {
+	c := newC()
+	prefixes := []string{"a", "idx:1:", "idx:1:long:", "idx:2:", "idx:2:long:", "idx:20:"}
+	for i := 0; i < 50000; i++ {
+		// keys inserted after the last key of a leaf can shorten its prefix
+		prefix := prefixes[rand.Intn(len(prefixes))]
+		key := fmt.Sprintf("%s%0*d", prefix, rand.Intn(200), rand.Intn(2000))
+		if rand.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, fmt.Sprintf("val%d", rand.Intn(100)))
+		}
+		if i%5000 == 0 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+	countLeaves(t, c, c.tree.Root)
+}
+
+// the leaves of files written before the prefix format
+func TestPrefixPlainLeaves(t *testing.T) {
+	c := newC()
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("key%d", rand.Intn(20000)), fmt.Sprintf("val%d", i))
+	}
+	converted := 0
+	for ptr, node := range c.pages {
+		if node.format() != BNODE_FORMAT_PREFIX {
+			continue
+		}
+		old := BNode{make([]byte, node.plainSize())}
+		old.setHeader(BNODE_LEAF, node.nkeys())
+		nodeAppendRange(old, node, 0, 0, node.nkeys())
+		if old.Nbytes() > BTREE_NODE_SIZE {
+			continue
+		}
+		page := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		copy(page.Data, old.Data)
+		c.pages[ptr] = page
+		converted++
+	}
+	if converted == 0 {
+		t.Fatalf("no plain leaves")
+	}
+	c.verify(t)
+
+	// updates mix both formats
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", rand.Intn(20000))
+		if rand.Intn(2) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, fmt.Sprintf("new%d", i))
+		}
+	}
+	c.verify(t)
+	for k, v := range c.ref {
+		got, ok := c.tree.Get([]byte(k))
+		if !ok || string(got) != v {
+			t.Fatalf("Get(%q): expected %q, got %q (%t)", k, v, got, ok)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bplustree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReadTxSnapshot(t *testing.T) {
+	db := openTestPager(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("old"))
+	}
+	rx := db.BeginRead()
+
+	// the writer keeps freeing and reusing pages,
+	// but not the ones the snapshot refers to.
+	for round := 0; round < 5; round++ {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("new%d", round)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		val, ok, _ := rx.Get([]byte(fmt.Sprintf("key%d", i)))
+		if !ok || string(val) != "old" {
+			t.Fatalf("snapshot key%d: expected old, got %q (%t)", i, val, ok)
+		}
+	}
+	rx.Done()
+
+	val, ok, _ := db.Get("key0")
+	if !ok || string(val) != "new4" {
+		t.Fatalf("key0: expected new4, got %q (%t)", val, ok)
+	}
+}
+
+func TestReadTxConcurrent(t *testing.T) {
+	db := openTestPager(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	const nkeys = 200
+	const rounds = 50
+	write := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < nkeys; i++ {
+			tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("%d", round)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Errorf("Commit: %v", err)
+		}
+	}
+	write(0)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// every key of a snapshot comes from the same commit
+				rx := db.BeginRead()
+				first, _, _ := rx.Get([]byte("key0"))
+				want := string(first)
+				rx.Scan([]byte("key"), nil, func(key []byte, val []byte) bool {
+					if string(val) != want {
+						t.Errorf("version %d: %s = %s, expected %s", rx.Version(), key, val, want)
+						return false
+					}
+					return true
+				})
+				rx.Done()
+			}
+		}()
+	}
+
+	for round := 1; round <= rounds; round++ {
+		write(round)
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,160 @@
+package bplustree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the shape of a tree, see Pager.Stats()
+type TreeStats struct {
+	Height   int // the number of levels, 0 for an empty tree
+	Internal int // internal nodes
+	Leaves   int
+	Keys     int // the keys in the leaves, including the dummy key
+	Bytes    int // used by the nodes as stored, see Fill()
+	Overflow int // overflow pages of large values
+}
+
+// the used fraction of the node pages
+func (s TreeStats) Fill(pageSize int) float64 {
+	if s.Internal+s.Leaves == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64((s.Internal+s.Leaves)*pageSize)
+}
+
+type Stats struct {
+	PageSize  int
+	Pages     uint64               // the used pages, including the master page
+	FileSize  int64                // of the file at Path, 0 in memory
+	FreePages int                  // in the free list, reused by later updates
+	FreeNodes int                  // the pages of the free list itself
+	Trees     map[string]TreeStats // by name, "" for the default tree
+}
+
+// the names of the committed trees, the default tree first
+func (db *Pager) treeRoots() ([]string, map[string]uint64) {
+	roots := map[string]uint64{"": db.tree.Root}
+	names := []string{""}
+	for name, root := range db.roots {
+		roots[name] = root
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names, roots
+}
+
+// count the pages of the committed trees and the free list.
+func (db *Pager) Stats() (stats Stats, err error) {
+	// no updates in the meantime
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	defer recoverPageError(&err)
+
+	stats = Stats{
+		PageSize:  db.PageSize,
+		Pages:     db.page.flushed,
+		FreePages: db.free.Total(),
+		Trees:     map[string]TreeStats{},
+	}
+	if db.Path != "" && db.Path != MEMORY_PATH {
+		if fi, err := os.Stat(db.Path); err == nil {
+			stats.FileSize = fi.Size()
+		}
+	}
+	if ptr := db.free.headPage; ptr != 0 {
+		for stats.FreeNodes = 1; ptr != db.free.tailPage; stats.FreeNodes++ {
+			ptr = LNode(db.free.get(ptr)).getNext()
+		}
+	}
+
+	names, roots := db.treeRoots()
+	for _, name := range names {
+		ts := TreeStats{}
+		if roots[name] != 0 {
+			treeStats(&db.tree, roots[name], 1, &ts)
+		}
+		stats.Trees[name] = ts
+	}
+	return stats, nil
+}
+
+func treeStats(tree *BTree, ptr uint64, depth int, ts *TreeStats) {
+	node := tree.get(ptr)
+	ts.Height = max(ts.Height, depth)
+	ts.Bytes += int(node.Nbytes())
+	if node.btype() == BNODE_LEAF {
+		ts.Leaves++
+		ts.Keys += int(node.nkeys())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.valOverflow(i) {
+				size, _ := overflowRef(node.GetVal(i))
+				ts.Overflow += int(tree.size.overflowPages(size))
+			}
+		}
+		return
+	}
+	ts.Internal++
+	for i := uint16(0); i < node.nkeys(); i++ {
+		treeStats(tree, node.getPtr(i), depth+1, ts)
+	}
+}
+
+// print the nodes of the committed trees, an internal node lists its
+// keys and pointers and a leaf its key range.
+func (db *Pager) Dump(w io.Writer) (err error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	defer recoverPageError(&err)
+
+	names, roots := db.treeRoots()
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "tree %q\n", name); err != nil {
+			return err
+		}
+		if roots[name] == 0 {
+			continue
+		}
+		if err := treeDump(w, &db.tree, roots[name], 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func treeDump(w io.Writer, tree *BTree, ptr uint64, depth int) error {
+	node := tree.get(ptr)
+	indent := strings.Repeat("  ", depth)
+	nkeys := node.nkeys()
+	if node.btype() == BNODE_LEAF {
+		prefix := ""
+		if node.format() == BNODE_FORMAT_PREFIX {
+			prefix = fmt.Sprintf(", prefix %q", node.prefix())
+		}
+		if nkeys == 0 {
+			_, err := fmt.Fprintf(w, "%sleaf %d: empty, %d bytes%s\n", indent, ptr, node.Nbytes(), prefix)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%sleaf %d: %d keys, %d bytes%s, %q .. %q\n",
+			indent, ptr, nkeys, node.Nbytes(), prefix, node.GetKey(0), node.GetKey(nkeys-1))
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%snode %d: %d keys, %d bytes\n", indent, ptr, nkeys, node.Nbytes())
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		_, err := fmt.Fprintf(w, "%s  %q -> %d\n", indent, node.GetKey(i), node.getPtr(i))
+		if err != nil {
+			return err
+		}
+		if err := treeDump(w, tree, node.getPtr(i), depth+2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package bplustree
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPagerStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+	defer db.Close()
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if ts := stats.Trees[""]; ts.Height != 0 || ts.Leaves != 0 {
+		t.Fatalf("empty tree: %+v", ts)
+	}
+
+	for i := 0; i < 5000; i++ {
+		val := []byte(fmt.Sprintf("val%d", i))
+		if i%1000 == 0 {
+			val = bytes.Repeat(val, 2000)
+		}
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := db.Tree("t").Set([]byte(fmt.Sprintf("k%d", i)), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	for i := 0; i < 5000; i += 2 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+
+	stats, err = db.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	ts := stats.Trees[""]
+	if ts.Height < 2 || ts.Internal == 0 || ts.Keys != 2500+1 {
+		t.Fatalf("default tree: %+v", ts)
+	}
+	// every page is used once
+	total := uint64(1 + stats.FreePages + stats.FreeNodes)
+	for _, ts := range stats.Trees {
+		total += uint64(ts.Internal + ts.Leaves + ts.Overflow)
+	}
+	if total != stats.Pages {
+		t.Fatalf("%d pages counted, %d used: %+v", total, stats.Pages, stats)
+	}
+	if stats.FileSize < int64(stats.Pages)*int64(stats.PageSize) {
+		t.Fatalf("file size %d for %d pages", stats.FileSize, stats.Pages)
+	}
+	if fill := ts.Fill(stats.PageSize); fill <= 0.2 || fill > 1 {
+		t.Fatalf("fill factor %f", fill)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "tree \"\"\n") || !strings.Contains(out, "tree \"t\"\n") {
+		t.Fatalf("Dump: %s", out)
+	}
+	if n := strings.Count(out, " leaf "); n != stats.Trees[""].Leaves+stats.Trees["t"].Leaves {
+		t.Fatalf("Dump: %d leaves", n)
+	}
+}
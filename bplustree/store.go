@@ -0,0 +1,102 @@
+package bplustree
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// the path of a database that only lives in memory
+const MEMORY_PATH = ":memory:"
+
+// the raw page storage under the Pager.
+// page 0 is the master page. the Pager does the rest: the tree,
+// the free list, checksums and transactions.
+// the page size is set after Open(), from the master page of the file.
+// before that, page 0 can be read for the master page slots.
+type PageStore interface {
+	// open or create the store, returns the number of pages in it.
+	Open() (uint64, error)
+	// set the page size, returns the number of pages of that size.
+	SetPageSize(size int) (uint64, error)
+	Close() error
+	// read a page. the data must not be modified, it stays valid
+	// until the page is written again. safe to call concurrently
+	// with writes to other pages.
+	ReadPage(ptr uint64) ([]byte, error)
+	// write a page, the store grows as needed.
+	// the data is copied and can be reused after the call.
+	WritePage(ptr uint64, page []byte) error
+	// write a part of the master page in one piece
+	WriteMaster(offset int, data []byte) error
+	// make the writes durable
+	Sync() error
+}
+
+// a store that keeps the pages in memory, nothing survives the process.
+// the content is kept after Close(), opening it again gets the same pages.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	pages    [][]byte
+	pageSize int // the pages are kept in this size
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{pageSize: BTREE_MIN_PAGE_SIZE}
+}
+
+func (s *MemoryStore) Open() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.pages)), nil
+}
+
+func (s *MemoryStore) SetPageSize(size int) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pages) > 0 && size != s.pageSize {
+		return 0, fmt.Errorf("the pages are %d bytes, not %d", s.pageSize, size)
+	}
+	s.pageSize = size
+	return uint64(len(s.pages)), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) ReadPage(ptr uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if ptr >= uint64(len(s.pages)) {
+		return nil, fmt.Errorf("page %d is out of %d pages", ptr, len(s.pages))
+	}
+	return s.pages[ptr], nil
+}
+
+func (s *MemoryStore) WritePage(ptr uint64, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert(len(page) <= s.pageSize)
+	// a new copy, readers may still hold the old one
+	data := make([]byte, s.pageSize)
+	copy(data, page)
+	for uint64(len(s.pages)) <= ptr {
+		s.pages = append(s.pages, make([]byte, s.pageSize))
+	}
+	s.pages[ptr] = data
+	return nil
+}
+
+func (s *MemoryStore) WriteMaster(offset int, data []byte) error {
+	page := make([]byte, MASTER_SLOT_SIZE*2)
+	if old, err := s.ReadPage(0); err == nil {
+		page = bytes.Clone(old)
+	}
+	copy(page[offset:], data)
+	return s.WritePage(0, page)
+}
+
+func (s *MemoryStore) Sync() error {
+	return nil
+}
@@ -0,0 +1,203 @@
+package bplustree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	// a relative path would be created in the working directory
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+	db := openTestPager(t, MEMORY_PATH)
+	defer db.Close()
+	if _, ok := db.Store.(*MemoryStore); !ok {
+		t.Fatalf("expected a MemoryStore, got %T", db.Store)
+	}
+
+	for i := 0; i < 2000; i++ {
+		val := []byte(fmt.Sprintf("val%d", i))
+		if i%100 == 0 {
+			val = bytes.Repeat(val, 2000) // overflow pages
+		}
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	rx := db.BeginRead()
+	for i := 0; i < 2000; i += 2 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatalf("Del: %v", err)
+		}
+	}
+	// the snapshot is not affected
+	if val, ok, _ := rx.Get([]byte("key100")); !ok || len(val) != 2000*len("val100") {
+		t.Fatalf("snapshot: got %d bytes (%t)", len(val), ok)
+	}
+	rx.Done()
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+
+	// nothing touches the disk
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("unexpected files: %v", files)
+	}
+}
+
+func TestMemoryStoreReopen(t *testing.T) {
+	store := NewMemoryStore()
+	db := &Pager{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db.Close()
+
+	// the same store, a new Pager
+	db = &Pager{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+		if !ok || string(val) != fmt.Sprintf("val%d", i) {
+			t.Fatalf("key%d: got %q (%t)", i, val, ok)
+		}
+	}
+}
+
+// both stores hold the same pages for the same updates
+func TestStoresMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	file := openTestPager(t, path)
+	defer file.Close()
+	mem := openTestPager(t, MEMORY_PATH)
+	defer mem.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i*7%1000))
+		for _, db := range []*Pager{file, mem} {
+			var err error
+			if i%3 == 0 {
+				_, err = db.Del(key)
+			} else {
+				err = db.Set(key, []byte(fmt.Sprintf("val%d", i)))
+			}
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+		}
+	}
+
+	if file.page.flushed != mem.page.flushed {
+		t.Fatalf("%d pages in the file, %d in memory", file.page.flushed, mem.page.flushed)
+	}
+	for ptr := uint64(0); ptr < file.page.flushed; ptr++ {
+		a, err := file.Store.ReadPage(ptr)
+		if err != nil {
+			t.Fatalf("file: %v", err)
+		}
+		b, err := mem.Store.ReadPage(ptr)
+		if err != nil {
+			t.Fatalf("memory: %v", err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("page %d differs", ptr)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &Pager{Path: path, CacheSize: 16 * BTREE_PAGE_SIZE}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	store, ok := db.Store.(*FileStore)
+	if !ok {
+		t.Fatalf("expected a FileStore, got %T", db.Store)
+	}
+
+	for i := 0; i < 3000; i++ {
+		val := []byte(fmt.Sprintf("val%d", i))
+		if i%100 == 0 {
+			val = bytes.Repeat(val, 2000) // overflow pages
+		}
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if n := store.cache.lru.Len(); n > 16 || n != len(store.cache.pages) {
+			t.Fatalf("%d pages cached, %d in the map", n, len(store.cache.pages))
+		}
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	db.Close()
+
+	// the same file format, mmap reads it
+	db = openTestPager(t, path)
+	defer db.Close()
+	for i := 0; i < 3000; i++ {
+		val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+		if !ok || !bytes.HasPrefix(val, []byte(fmt.Sprintf("val%d", i))) {
+			t.Fatalf("key%d: got %q (%t)", i, val, ok)
+		}
+	}
+}
+
+// I/O errors are returned, not SIGBUS
+func TestFileStoreErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &Pager{Path: path, CacheSize: BTREE_PAGE_SIZE}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	if _, err := db.Store.ReadPage(db.page.flushed); err == nil {
+		t.Fatalf("expected an error for a page out of the file")
+	}
+	// pages that are not cached can't be read anymore
+	if err := os.Truncate(path, 2*BTREE_PAGE_SIZE); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	err := db.Set([]byte("key1000"), []byte("new"))
+	var perr *PageError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a *PageError, got %v", err)
+	}
+	if _, err := db.Del([]byte("key1500")); !errors.As(err, &perr) {
+		t.Fatalf("expected a *PageError, got %v", err)
+	}
+	// and the reads don't panic either
+	if _, _, err := db.Get("key1500"); !errors.As(err, &perr) {
+		t.Fatalf("Get: expected a *PageError, got %v", err)
+	}
+	err = db.Scan([]byte("key"), nil, func(key []byte, val []byte) bool { return true })
+	if !errors.As(err, &perr) {
+		t.Fatalf("Scan: expected a *PageError, got %v", err)
+	}
+	// the writer is not left locked
+	tx := db.Begin()
+	tx.Abort()
+}
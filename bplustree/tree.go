@@ -3,6 +3,8 @@ package bplustree
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
+	"slices"
 )
 
 func assert(cond bool) {
@@ -13,13 +15,54 @@ func assert(cond bool) {
 
 const HEADER = 4
 
+// the page size is chosen when a file is created, see Pager.PageSize.
+// the sizes below are of the default page size.
 const BTREE_PAGE_SIZE = 4096
+const BTREE_MIN_PAGE_SIZE = 4096
+const BTREE_MAX_PAGE_SIZE = 65536
+const BTREE_PAGE_TRAILER = 4 // page checksum, see pageSetChecksum()
+const BTREE_NODE_SIZE = BTREE_PAGE_SIZE - BTREE_PAGE_TRAILER
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
+// positions in a node are 16 bits. nodes in memory can be bigger than
+// a page before they are split, so nodes on larger pages are limited.
+const BTREE_NODE_MAX = 48 << 10
+
+// the values kept in a leaf grow with the page size up to this
+const BTREE_VAL_MAX = 12000
+
+// the sizes that follow from the page size of a file
+type treeSizes struct {
+	page        int // the page size
+	node        int // the space for a node, BTREE_NODE_SIZE for the default
+	plainMax    int // the limit of a leaf in memory, see nodeRangeFits()
+	maxVal      int // larger values are moved to overflow pages
+	overflowCap int // the data of an overflow page
+}
+
+func newTreeSizes(pageSize int) treeSizes {
+	s := treeSizes{page: pageSize}
+	s.node = min(pageSize-BTREE_PAGE_TRAILER, BTREE_NODE_MAX)
+	s.plainMax = min(4*pageSize, BTREE_NODE_MAX)
+	s.maxVal = min(BTREE_MAX_VAL_SIZE*(pageSize/BTREE_PAGE_SIZE), BTREE_VAL_MAX)
+	s.overflowCap = pageSize - BTREE_PAGE_TRAILER - OVERFLOW_HEADER
+	return s
+}
+
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1max <= BTREE_PAGE_SIZE)
+	for size := BTREE_MIN_PAGE_SIZE; size <= BTREE_MAX_PAGE_SIZE; size *= 2 {
+		s := newTreeSizes(size)
+		node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + s.maxVal
+		assert(node1max <= s.node)
+		// a leaf with an inserted KV, see treeInsert()
+		assert(s.plainMax+node1max <= math.MaxUint16)
+		// an internal node with 2 more keys, see nodeReplaceKidN()
+		assert(s.node+2*(8+2+4+BTREE_MAX_KEY_SIZE) <= math.MaxUint16)
+		// 2 merged internal nodes, see shouldMerge()
+		assert(s.node+s.node/4 <= math.MaxUint16)
+	}
+	assert(newTreeSizes(BTREE_PAGE_SIZE).node == BTREE_NODE_SIZE)
 }
 
 const (
@@ -33,13 +76,15 @@ type BNode struct {
 
 type BTree struct {
 	Root uint64
+	size treeSizes          // see Pager.PageSize
 	get  func(uint64) BNode // dereference a pointer
 	new  func(BNode) uint64 // allocate a new page
 	del  func(uint64)       // deallocate a page
 }
 
+// the low byte of the type, the high byte is the format, see prefix.go
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node.Data)
+	return uint16(node.Data[0])
 }
 func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node.Data[2:4])
@@ -52,18 +97,30 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 // pointers
 func (node BNode) getPtr(idx uint16) uint64 {
 	assert(idx < node.nkeys())
+	if node.format() == BNODE_FORMAT_PREFIX {
+		return 0 // a leaf
+	}
 	pos := HEADER + 8*idx
 	return binary.LittleEndian.Uint64(node.Data[pos:])
 }
 func (node BNode) setPtr(idx uint16, val uint64) {
 	assert(idx < node.nkeys())
+	assert(node.format() == BNODE_FORMAT_PLAIN)
 	pos := HEADER + 8*idx
 	binary.LittleEndian.PutUint64(node.Data[pos:], val)
 }
 
+// the offsets follow the pointers, or the prefix of a prefix leaf
+func (node BNode) offsetsPos() uint16 {
+	if node.format() == BNODE_FORMAT_PREFIX {
+		return HEADER + 2 + uint16(len(node.prefix()))
+	}
+	return HEADER + 8*node.nkeys()
+}
+
 func offsetPos(node BNode, idx uint16) uint16 {
 	assert(1 <= idx && idx <= node.nkeys())
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.offsetsPos() + 2*(idx-1)
 }
 
 func (node BNode) getOffset(idx uint16) uint16 {
@@ -75,37 +132,56 @@ func (node BNode) getOffset(idx uint16) uint16 {
 
 func (node BNode) kvPos(idx uint16) uint16 {
 	assert(idx <= node.nkeys())
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.offsetsPos() + 2*node.nkeys() + node.getOffset(idx)
 }
+
+// the key of a prefix leaf is a copy
 func (node BNode) GetKey(idx uint16) []byte {
-	assert(idx < node.nkeys())
-	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.Data[pos:])
-	return node.Data[pos+4:][:klen]
+	key := node.keySuffix(idx)
+	if node.format() == BNODE_FORMAT_PREFIX && len(node.prefix()) > 0 {
+		return slices.Concat(node.prefix(), key)
+	}
+	return key
 }
 
+// the value as stored in the node, see valOverflow()
 func (node BNode) GetVal(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.Data[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node.Data[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node.Data[pos+2:]) & VAL_LEN_MASK
 	return node.Data[pos+4+klen:][:vlen]
 }
+
+// the stored value is a reference to overflow pages
+func (node BNode) valOverflow(idx uint16) bool {
+	assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node.Data[pos+2:])&VAL_OVERFLOW != 0
+}
+
+func (node BNode) setValOverflow(idx uint16) {
+	pos := node.kvPos(idx)
+	vlen := binary.LittleEndian.Uint16(node.Data[pos+2:])
+	binary.LittleEndian.PutUint16(node.Data[pos+2:], vlen|VAL_OVERFLOW)
+}
+
+// find the last key that is less than or equal to the key
 func NodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	found := uint16(0)
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key.
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.GetKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+	// binary search in the rest: keys in [1, lo) are <= key,
+	// keys in [hi, nkeys) are > key.
+	lo, hi := uint16(1), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if node.compareKey(mid, key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1
 }
 
 func leafInsert(
@@ -142,6 +218,16 @@ func nodeAppendRange(
 	if n == 0 {
 		return
 	}
+	if old.format() == BNODE_FORMAT_PREFIX {
+		// the keys are restored in full
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(new, dstNew+i, 0, old.GetKey(srcOld+i), old.GetVal(srcOld+i))
+			if old.valOverflow(srcOld + i) {
+				new.setValOverflow(dstNew + i)
+			}
+		}
+		return
+	}
 
 	// pointers
 	for i := uint16(0); i < n; i++ {
@@ -166,26 +252,20 @@ func (node BNode) Nbytes() uint16 {
 
 // split a bigger-than-allowed node into two.
 // the second node always fits on a page.
-func nodeSplit2(left BNode, right BNode, old BNode) {
+func nodeSplit2(size treeSizes, left BNode, right BNode, old BNode) {
 	assert(old.nkeys() >= 2)
 
 	// the initial guess
 	nleft := old.nkeys() / 2
 
 	// try to fit the left half
-	left_bytes := func() uint16 {
-		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
-	}
-	for left_bytes() > BTREE_PAGE_SIZE {
+	for !nodeRangeFits(size, old, 0, nleft) {
 		nleft--
 	}
 	assert(nleft >= 1)
 
 	// try to fit the right half
-	right_bytes := func() uint16 {
-		return old.Nbytes() - left_bytes() + HEADER
-	}
-	for right_bytes() > BTREE_PAGE_SIZE {
+	for !nodeRangeFits(size, old, nleft, old.nkeys()) {
 		nleft++
 	}
 	assert(nleft < old.nkeys())
@@ -196,32 +276,34 @@ func nodeSplit2(left BNode, right BNode, old BNode) {
 	nodeAppendRange(left, old, 0, 0, nleft)
 	nodeAppendRange(right, old, 0, nleft, nright)
 	// the left half may be still too big
-	assert(right.Nbytes() <= BTREE_PAGE_SIZE)
+	assert(nodeFits(size, right))
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.Nbytes() <= BTREE_PAGE_SIZE {
-		old.Data = old.Data[:BTREE_PAGE_SIZE]
+// the sizes are of the page format, see nodeEncode(),
+// the plain nodes in memory may be bigger than 1 page.
+func nodeSplit3(size treeSizes, old BNode) (uint16, [3]BNode) {
+	if nodeFits(size, old) {
 		return 1, [3]BNode{old}
 	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(left, right, old)
-	if left.Nbytes() <= BTREE_PAGE_SIZE {
-		left.Data = left.Data[:BTREE_PAGE_SIZE]
+	left := BNode{make([]byte, old.Nbytes())} // might be split later
+	right := BNode{make([]byte, old.Nbytes())}
+	nodeSplit2(size, left, right, old)
+	if nodeFits(size, left) {
 		return 2, [3]BNode{left, right}
 	}
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	assert(leftleft.Nbytes() <= BTREE_PAGE_SIZE)
+	leftleft := BNode{make([]byte, left.Nbytes())}
+	middle := BNode{make([]byte, left.Nbytes())}
+	nodeSplit2(size, leftleft, middle, left)
+	assert(nodeFits(size, leftleft))
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	// ptrs
-	new.setPtr(idx, ptr)
+	if new.format() == BNODE_FORMAT_PLAIN {
+		new.setPtr(idx, ptr)
+	}
 	// KVs
 	pos := new.kvPos(idx)
 	binary.LittleEndian.PutUint16(new.Data[pos+0:], uint16(len(key)))
@@ -232,10 +314,10 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte, ovf bool) BNode {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode{Data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := BNode{Data: make([]byte, node.plainSize()+tree.size.page)}
 
 	// where to insert the key?
 	idx := NodeLookupLE(node, key)
@@ -243,16 +325,23 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.GetKey(idx)) {
+		if node.compareKey(idx, key) == 0 {
 			// found the key, update it.
+			if node.valOverflow(idx) {
+				overflowFree(tree, node.GetVal(idx))
+			}
 			leafUpdate(new, node, idx, key, val)
 		} else {
 			// insert it after the position.
-			leafInsert(new, node, idx+1, key, val)
+			idx++
+			leafInsert(new, node, idx, key, val)
+		}
+		if ovf {
+			new.setValOverflow(idx)
 		}
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, new, node, idx, key, val)
+		nodeInsert(tree, new, node, idx, key, val, ovf)
 	default:
 		panic("bad node!")
 	}
@@ -271,67 +360,80 @@ func nodeReplaceKidN(
 	inc := uint16(len(kids))
 	if inc == 1 && bytes.Equal(kids[0].GetKey(0), old.GetKey(idx)) {
 		// common case, only replace 1 pointer
-		nodeReplaceKid1ptr(new, old, idx, tree.new(kids[0]))
+		nodeReplaceKid1ptr(new, old, idx, tree.newNode(kids[0]))
 		return
 	}
 
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.GetKey(0), nil)
+		nodeAppendKV(new, idx+uint16(i), tree.newNode(node), node.GetKey(0), nil)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
 func nodeInsert(
 	tree *BTree, new BNode, node BNode, idx uint16,
-	key []byte, val []byte,
+	key []byte, val []byte, ovf bool,
 ) {
 	// get and deallocate the kid node
 	kptr := node.getPtr(idx)
 	knode := tree.get(kptr)
 	tree.del(kptr)
 	// recursive insertion to the kid node
-	knode = treeInsert(tree, knode, key, val)
+	knode = treeInsert(tree, knode, key, val, ovf)
 	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	nsplit, splited := nodeSplit3(tree.size, knode)
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
 }
 
+// write a node in its page format
+func (tree *BTree) newNode(node BNode) uint64 {
+	return tree.new(nodeEncode(tree.size, node))
+}
+
 func (tree *BTree) Insert(key []byte, val []byte) {
 	assert(len(key) != 0)
 	assert(len(key) <= BTREE_MAX_KEY_SIZE)
-	// assert(len(val) <= BTREE_MAX_VAL_SIZE)
+
+	// large values are moved out of the leaf
+	ovf := len(val) > tree.size.maxVal
+	if ovf {
+		val = overflowStore(tree, val)
+	}
 
 	if tree.Root == 0 {
 		// create the first node
-		Root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		Root := BNode{Data: make([]byte, tree.size.page)}
 		Root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		nodeAppendKV(Root, 0, 0, nil, nil)
 		nodeAppendKV(Root, 1, 0, key, val)
-		tree.Root = tree.new(Root)
+		if ovf {
+			Root.setValOverflow(1)
+		}
+		tree.Root = tree.newNode(Root)
 		return
 	}
 
 	node := tree.get(tree.Root)
 	tree.del(tree.Root)
 
-	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := nodeSplit3(node)
+	node = treeInsert(tree, node, key, val, ovf)
+	nsplit, splitted := nodeSplit3(tree.size, node)
 	if nsplit > 1 {
 		// the Root was split, add a new level.
-		Root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		Root := BNode{Data: make([]byte, tree.size.page)}
 		Root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.new(knode), knode.GetKey(0)
+			ptr, key := tree.newNode(knode), knode.GetKey(0)
 			nodeAppendKV(Root, uint16(i), ptr, key, nil)
 		}
-		tree.Root = tree.new(Root)
+		tree.Root = tree.newNode(Root)
 	} else {
-		tree.Root = tree.new(splitted[0])
+		tree.Root = tree.newNode(splitted[0])
 	}
 }
 
@@ -339,8 +441,8 @@ func nodeGetKey(tree *BTree, node BNode, key []byte) ([]byte, bool) {
 	idx := NodeLookupLE(node, key)
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.GetKey(idx)) {
-			return node.GetVal(idx), true
+		if node.compareKey(idx, key) == 0 {
+			return treeGetVal(tree, node, idx), true
 		} else {
 			return nil, false
 		}
@@ -357,3 +459,160 @@ func (tree *BTree) Get(key []byte) ([]byte, bool) {
 	}
 	return nodeGetKey(tree, tree.get(tree.Root), key)
 }
+
+// remove a key from a leaf node
+func leafDelete(new BNode, old BNode, idx uint16) {
+	new.setHeader(BNODE_LEAF, old.nkeys()-1)
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
+}
+
+// merge 2 nodes into 1
+func nodeMerge(new BNode, left BNode, right BNode) {
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	nodeAppendRange(new, left, 0, 0, left.nkeys())
+	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+}
+
+// replace 2 adjacent links with the merged or redistributed kids
+func nodeReplace2Kid(
+	tree *BTree, new BNode, old BNode, idx uint16,
+	kids ...BNode,
+) {
+	inc := uint16(len(kids))
+	new.setHeader(BNODE_NODE, old.nkeys()+inc-2)
+	nodeAppendRange(new, old, 0, 0, idx)
+	for i, node := range kids {
+		nodeAppendKV(new, idx+uint16(i), tree.newNode(node), node.GetKey(0), nil)
+	}
+	nodeAppendRange(new, old, idx+inc, idx+2, old.nkeys()-(idx+2))
+}
+
+// should the updated kid be merged with (or take keys from) a sibling?
+// returns the index of the left one of the 2 kids, and the sibling.
+func shouldMerge(
+	tree *BTree, node BNode,
+	idx uint16, updated BNode,
+) (int, BNode) {
+	if nodeSize(updated) > tree.size.node/4 {
+		return 0, BNode{}
+	}
+	// the merged node in memory, leaves can be bigger than a page
+	fits := func(sibling BNode) bool {
+		return int(updated.Nbytes())+sibling.plainSize() <= math.MaxUint16
+	}
+
+	if idx > 0 {
+		sibling := tree.get(node.getPtr(idx - 1))
+		if fits(sibling) {
+			return -1, sibling
+		}
+	}
+	if idx+1 < node.nkeys() {
+		sibling := tree.get(node.getPtr(idx + 1))
+		if fits(sibling) {
+			return +1, sibling
+		}
+	}
+	return 0, BNode{}
+}
+
+// delete a key from the tree
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+	// where to find the key?
+	idx := NodeLookupLE(node, key)
+	// act depending on the node type
+	switch node.btype() {
+	case BNODE_LEAF:
+		if idx >= node.nkeys() || node.compareKey(idx, key) != 0 {
+			return BNode{} // not found
+		}
+		// delete the key in the leaf
+		if node.valOverflow(idx) {
+			overflowFree(tree, node.GetVal(idx))
+		}
+		new := BNode{Data: make([]byte, node.plainSize())}
+		leafDelete(new, node, idx)
+		return new
+	case BNODE_NODE:
+		return nodeDelete(tree, node, idx, key)
+	default:
+		panic("bad node!")
+	}
+}
+
+// part of the treeDelete()
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+	// recurse into the kid
+	kptr := node.getPtr(idx)
+	updated := treeDelete(tree, tree.get(kptr), key)
+	if len(updated.Data) == 0 {
+		return BNode{} // not found
+	}
+	tree.del(kptr)
+
+	// the result node.
+	// a replaced separator key can make it bigger than 1 page,
+	// the caller splits it if so
+	new := BNode{Data: make([]byte, 2*tree.size.page)}
+
+	// check for merging or redistribution
+	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	switch {
+	case mergeDir < 0: // left
+		tree.del(node.getPtr(idx - 1))
+		nodeReplace2Kid(tree, new, node, idx-1, nodeRebalance(tree.size, sibling, updated)...)
+	case mergeDir > 0: // right
+		tree.del(node.getPtr(idx + 1))
+		nodeReplace2Kid(tree, new, node, idx, nodeRebalance(tree.size, updated, sibling)...)
+	case mergeDir == 0 && updated.nkeys() == 0:
+		// an empty kid without siblings, the parent becomes empty too
+		assert(node.nkeys() == 1 && idx == 0)
+		new.setHeader(BNODE_NODE, 0)
+	case mergeDir == 0:
+		nsplit, splited := nodeSplit3(tree.size, updated)
+		nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	}
+	return new
+}
+
+// merge 2 siblings into 1 node if they fit,
+// otherwise redistribute their keys evenly between 2 nodes.
+func nodeRebalance(size treeSizes, left BNode, right BNode) []BNode {
+	merged := BNode{Data: make([]byte, left.plainSize()+right.plainSize())}
+	nodeMerge(merged, left, right)
+	nsplit, splited := nodeSplit3(size, merged)
+	return splited[:nsplit]
+}
+
+func (tree *BTree) Delete(key []byte) bool {
+	assert(len(key) != 0)
+	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	if tree.Root == 0 {
+		return false
+	}
+
+	updated := treeDelete(tree, tree.get(tree.Root), key)
+	if len(updated.Data) == 0 {
+		return false // not found
+	}
+
+	tree.del(tree.Root)
+	nsplit, splitted := nodeSplit3(tree.size, updated)
+	if nsplit > 1 {
+		// a replaced separator key split the Root, add a new level.
+		Root := BNode{Data: make([]byte, tree.size.page)}
+		Root.setHeader(BNODE_NODE, nsplit)
+		for i, knode := range splitted[:nsplit] {
+			ptr, key := tree.newNode(knode), knode.GetKey(0)
+			nodeAppendKV(Root, uint16(i), ptr, key, nil)
+		}
+		tree.Root = tree.newNode(Root)
+	} else if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		// remove a level
+		tree.Root = updated.getPtr(0)
+	} else {
+		tree.Root = tree.newNode(splitted[0])
+	}
+	return true
+}
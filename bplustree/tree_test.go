@@ -0,0 +1,266 @@
+package bplustree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+type C struct {
+	tree  BTree
+	ref   map[string]string
+	pages map[uint64]BNode
+	next  uint64
+}
+
+func newC() *C {
+	c := &C{
+		ref:   map[string]string{},
+		pages: map[uint64]BNode{},
+		next:  1,
+	}
+	c.tree = BTree{
+		size: newTreeSizes(BTREE_PAGE_SIZE),
+		get: func(ptr uint64) BNode {
+			node, ok := c.pages[ptr]
+			assert(ok)
+			return node
+		},
+		new: func(node BNode) uint64 {
+			assert(int(node.Nbytes()) <= c.tree.size.node)
+			ptr := c.next
+			c.next++
+			c.pages[ptr] = node
+			return ptr
+		},
+		del: func(ptr uint64) {
+			_, ok := c.pages[ptr]
+			assert(ok)
+			delete(c.pages, ptr)
+		},
+	}
+	return c
+}
+
+func (c *C) add(key string, val string) {
+	c.tree.Insert([]byte(key), []byte(val))
+	c.ref[key] = val
+}
+
+func (c *C) del(key string) bool {
+	delete(c.ref, key)
+	return c.tree.Delete([]byte(key))
+}
+
+// walk the tree, check the node invariants and collect the KVs.
+func (c *C) dump(t *testing.T) ([]string, []string) {
+	keys := []string{}
+	vals := []string{}
+	if c.tree.Root == 0 {
+		return keys, vals
+	}
+
+	reachable := 0
+	var walk func(ptr uint64, lower []byte)
+	walk = func(ptr uint64, lower []byte) {
+		node := c.tree.get(ptr)
+		reachable++
+		if int(node.Nbytes()) > c.tree.size.node {
+			t.Fatalf("node %d is too big: %d", ptr, node.Nbytes())
+		}
+		nkeys := node.nkeys()
+		for i := uint16(1); i < nkeys; i++ {
+			if bytes.Compare(node.GetKey(i-1), node.GetKey(i)) >= 0 {
+				t.Fatalf("node %d: keys out of order at %d", ptr, i)
+			}
+		}
+		if nkeys > 0 && lower != nil && !bytes.Equal(node.GetKey(0), lower) {
+			t.Fatalf("node %d: first key %q != parent key %q", ptr, node.GetKey(0), lower)
+		}
+		switch node.btype() {
+		case BNODE_LEAF:
+			for i := uint16(0); i < nkeys; i++ {
+				keys = append(keys, string(node.GetKey(i)))
+				vals = append(vals, string(treeGetVal(&c.tree, node, i)))
+				if node.valOverflow(i) {
+					size, _ := overflowRef(node.GetVal(i))
+					reachable += int(c.tree.size.overflowPages(size))
+				}
+			}
+		case BNODE_NODE:
+			for i := uint16(0); i < nkeys; i++ {
+				walk(node.getPtr(i), node.GetKey(i))
+			}
+		default:
+			t.Fatalf("node %d: bad type %d", ptr, node.btype())
+		}
+	}
+	walk(c.tree.Root, nil)
+
+	if reachable != len(c.pages) {
+		t.Fatalf("leaked pages: %d reachable, %d allocated", reachable, len(c.pages))
+	}
+	return keys, vals
+}
+
+func (c *C) verify(t *testing.T) {
+	if c.tree.Root == 0 {
+		if len(c.ref) != 0 {
+			t.Fatalf("expected %d keys in an empty tree", len(c.ref))
+		}
+		return
+	}
+	keys, vals := c.dump(t)
+
+	refKeys := []string{""} // the dummy key
+	for k := range c.ref {
+		refKeys = append(refKeys, k)
+	}
+	sort.Strings(refKeys)
+
+	if len(keys) != len(refKeys) {
+		t.Fatalf("expected %d keys, got %d", len(refKeys), len(keys))
+	}
+	for i := range keys {
+		if keys[i] != refKeys[i] {
+			t.Fatalf("expected key: %q, got: %q", refKeys[i], keys[i])
+		}
+		if i > 0 && vals[i] != c.ref[keys[i]] {
+			t.Fatalf("key %q: expected val: %q, got: %q", keys[i], c.ref[keys[i]], vals[i])
+		}
+	}
+}
+
+func TestBTreeInsertGet(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key%d", rand.Intn(50000)), fmt.Sprintf("val%d", i))
+	}
+	c.verify(t)
+
+	for k, v := range c.ref {
+		got, ok := c.tree.Get([]byte(k))
+		if !ok || string(got) != v {
+			t.Fatalf("Get(%q): expected %q, got %q (%t)", k, v, got, ok)
+		}
+	}
+	if _, ok := c.tree.Get([]byte("missing")); ok {
+		t.Fatalf("Get(missing): expected not found")
+	}
+}
+
+func TestBTreeDelete(t *testing.T) {
+	c := newC()
+	keys := []string{}
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%07d", i)
+		keys = append(keys, key)
+		c.add(key, fmt.Sprintf("val%d", i))
+	}
+	c.verify(t)
+
+	if c.del("missing") {
+		t.Fatalf("Delete(missing): expected false")
+	}
+
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for i, key := range keys {
+		if !c.del(key) {
+			t.Fatalf("Delete(%q): expected true", key)
+		}
+		if c.del(key) {
+			t.Fatalf("Delete(%q) twice: expected false", key)
+		}
+		if i%1000 == 0 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+
+	// only the root leaf with the dummy key is left
+	root := c.tree.get(c.tree.Root)
+	if root.btype() != BNODE_LEAF || root.nkeys() != 1 {
+		t.Fatalf("expected an empty root leaf, got type %d with %d keys", root.btype(), root.nkeys())
+	}
+}
+
+func TestBTreeRandomOps(t *testing.T) {
+	c := newC()
+	for i := 0; i < 50000; i++ {
+		key := fmt.Sprintf("k%d", rand.Intn(5000))
+		if rand.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			// variable sized values make nodes unevenly filled
+			c.add(key, string(bytes.Repeat([]byte{'v'}, rand.Intn(400))))
+		}
+		if i%5000 == 0 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+}
+
+func TestBTreePageSizes(t *testing.T) {
+	for _, pageSize := range []int{16384, 65536} {
+		c := newC()
+		c.tree.size = newTreeSizes(pageSize)
+		for i := 0; i < 30000; i++ {
+			// long shared prefixes make the leaves bigger in memory
+			key := fmt.Sprintf("%0*d", 1+rand.Intn(500), rand.Intn(3000))
+			if rand.Intn(3) == 0 {
+				c.del(key)
+			} else {
+				c.add(key, string(bytes.Repeat([]byte{'v'}, rand.Intn(c.tree.size.maxVal+100))))
+			}
+			if i%5000 == 0 {
+				c.verify(t)
+			}
+		}
+		c.verify(t)
+		for k := range c.ref {
+			c.del(k)
+		}
+		c.verify(t)
+	}
+}
+
+func TestBTreeDeleteLargeKeys(t *testing.T) {
+	c := newC()
+	for i := 0; i < 2000; i++ {
+		// long keys of different lengths, replacing separators
+		// can make internal nodes grow
+		key := fmt.Sprintf("%0*d", 10+rand.Intn(BTREE_MAX_KEY_SIZE-10), i)
+		c.add(key, "v")
+	}
+	c.verify(t)
+	for k := range c.ref {
+		c.del(k)
+	}
+	c.verify(t)
+}
+
+func TestBTreeOverflow(t *testing.T) {
+	c := newC()
+	ovfCap := c.tree.size.overflowCap
+	sizes := []int{BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1, ovfCap, ovfCap + 1, 100000}
+	for i := 0; i < 300; i++ {
+		size := sizes[rand.Intn(len(sizes))]
+		val := bytes.Repeat([]byte{byte('a' + i%26)}, size)
+		c.add(fmt.Sprintf("key%d", rand.Intn(100)), string(val))
+	}
+	c.verify(t)
+
+	for k, v := range c.ref {
+		got, ok := c.tree.Get([]byte(k))
+		if !ok || string(got) != v {
+			t.Fatalf("Get(%q): got %d bytes, expected %d", k, len(got), len(v))
+		}
+	}
+	for k := range c.ref {
+		c.del(k)
+	}
+	c.verify(t)
+}
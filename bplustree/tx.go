@@ -0,0 +1,239 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or aborted")
+var ErrEmptyKey = errors.New("empty key")
+var ErrKeyTooLarge = fmt.Errorf("key is larger than %d bytes", BTREE_MAX_KEY_SIZE)
+var ErrFailed = errors.New("the master page may be partially updated, reopen the database")
+
+// the error of an update with the key, without the update
+func CheckKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	return nil
+}
+
+// a group of updates that is committed or aborted as a whole.
+// the updated pages stay in memory (`page.temp` and `page.updates`)
+// until Commit() writes them out. only 1 transaction at a time,
+// Begin() blocks until the previous one is done.
+type Tx struct {
+	db   *Pager
+	done bool
+	// saved states for the rollback
+	root    uint64
+	roots   map[string]uint64
+	free    FreeList
+	flushed uint64
+}
+
+// start a transaction
+func (db *Pager) Begin() *Tx {
+	db.writer.Lock()
+	assert(len(db.page.temp) == 0 && len(db.page.updates) == 0)
+
+	// pages freed after the oldest snapshot in use can't be reused yet
+	db.mu.Lock()
+	maxSeq := db.snap.tailSeq
+	for rx := range db.readers {
+		maxSeq = min(maxSeq, rx.tailSeq)
+	}
+	db.mu.Unlock()
+	db.free.SetMaxSeq(maxSeq)
+
+	tx := &Tx{db: db, root: db.tree.Root, free: db.free, flushed: db.page.flushed}
+	tx.roots = maps.Clone(db.roots)
+	return tx
+}
+
+// a bad page is returned as a *PageError, the transaction can go on.
+func (tx *Tx) Get(key []byte) (val []byte, found bool, err error) {
+	defer recoverPageError(&err)
+	val, found = tx.db.tree.Get(key)
+	return val, found, nil
+}
+
+// values of any size are accepted, keys are limited to BTREE_MAX_KEY_SIZE.
+func (tx *Tx) Set(key []byte, val []byte) (err error) {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	defer tx.recoverPage(&err)
+	tx.db.tree.Insert(key, val)
+	return nil
+}
+
+func (tx *Tx) Del(key []byte) (deleted bool, err error) {
+	if err := tx.check(); err != nil {
+		return false, err
+	}
+	if err := CheckKey(key); err != nil {
+		return false, err
+	}
+	defer tx.recoverPage(&err)
+	return tx.db.tree.Delete(key), nil
+}
+
+// write out the updates, all of them land on disk or none do.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	db := tx.db
+	defer db.writer.Unlock()
+
+	if db.failed != nil {
+		txRollback(tx)
+		return db.failed
+	}
+	if db.tree.Root == tx.root && len(db.page.temp) == 0 && len(db.page.updates) == 0 {
+		return nil // nothing to do
+	}
+	if err := flushPages(db); err != nil {
+		// the master page is not updated, the old root stays valid
+		txRollback(tx)
+		return err
+	}
+
+	// new readers see the new version
+	db.mu.Lock()
+	db.version++
+	db.snap.root = db.tree.Root
+	db.snap.flushed = db.page.flushed
+	db.snap.tailSeq = db.free.tailSeq
+	db.snap.roots = maps.Clone(db.roots)
+	db.mu.Unlock()
+	return nil
+}
+
+// the transaction can still be updated
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.db.ReadOnly {
+		return ErrReadOnly
+	}
+	return tx.db.failed
+}
+
+// bad pages panic in the tree, the update is left half done.
+// deferred by updates to abort the transaction and return the error.
+func (tx *Tx) recoverPage(err *error) {
+	if r := recover(); r != nil {
+		perr, ok := r.(*PageError)
+		if !ok {
+			panic(r)
+		}
+		tx.Abort()
+		*err = perr
+	}
+}
+
+// discard the updates
+func (tx *Tx) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	txRollback(tx)
+	tx.db.writer.Unlock()
+}
+
+func txRollback(tx *Tx) {
+	db := tx.db
+	db.tree.Root = tx.root
+	db.roots = tx.roots
+	db.free = tx.free
+	db.page.flushed = tx.flushed
+	db.page.temp = db.page.temp[:0]
+	db.page.updates = map[uint64][]byte{}
+}
+
+// a read-only snapshot of the committed tree.
+// readers don't block the writer or each other, pages reachable from
+// the snapshot are not reused until the reader is done.
+type ReadTx struct {
+	db      *Pager
+	tree    BTree
+	roots   map[string]uint64 // the named trees
+	flushed uint64
+	version uint64
+	tailSeq uint64 // the free list tail at the time of the snapshot
+	done    bool
+}
+
+// pin the committed version for reading
+func (db *Pager) BeginRead() *ReadTx {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rx := &ReadTx{
+		db:      db,
+		flushed: db.snap.flushed,
+		version: db.version,
+		tailSeq: db.snap.tailSeq,
+		roots:   db.snap.roots,
+	}
+	rx.tree.Root = db.snap.root
+	rx.tree.size = db.tree.size
+	store, checksum := db.Store, db.checksum
+	rx.tree.get = func(ptr uint64) BNode {
+		return pageGetChecked(store, rx.flushed, checksum, ptr)
+	}
+	db.readers[rx] = struct{}{}
+	return rx
+}
+
+// release the snapshot, the returned keys and values become invalid.
+func (rx *ReadTx) Done() {
+	if rx.done {
+		return
+	}
+	rx.done = true
+	rx.db.mu.Lock()
+	delete(rx.db.readers, rx)
+	rx.db.mu.Unlock()
+}
+
+func (rx *ReadTx) Version() uint64 {
+	return rx.version
+}
+
+func (rx *ReadTx) Get(key []byte) (val []byte, found bool, err error) {
+	assert(!rx.done)
+	defer recoverPageError(&err)
+	val, found = rx.tree.Get(key)
+	return val, found, nil
+}
+
+// the iterators panic with a *PageError on a bad page, Scan() returns it.
+func (rx *ReadTx) SeekLE(key []byte) *BIter {
+	assert(!rx.done)
+	return rx.tree.SeekLE(key)
+}
+
+func (rx *ReadTx) SeekGE(key []byte) *BIter {
+	assert(!rx.done)
+	return rx.tree.SeekGE(key)
+}
+
+// see Pager.Scan()
+func (rx *ReadTx) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) (err error) {
+	assert(!rx.done)
+	defer recoverPageError(&err)
+	treeScan(&rx.tree, start, end, fn)
+	return nil
+}
@@ -0,0 +1,80 @@
+package bplustree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	tx := db.Begin()
+	for i := 0; i < 500; i++ {
+		tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte("val"))
+	}
+	tx.Del([]byte("key0"))
+	// uncommitted updates are visible inside the transaction
+	if _, ok, _ := tx.Get([]byte("key1")); !ok {
+		t.Fatalf("Get inside the transaction: expected key1")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := tx.Set([]byte("late"), []byte("val")); err != ErrTxDone {
+		t.Fatalf("Set after Commit: expected ErrTxDone, got %v", err)
+	}
+	db.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	if _, ok, _ := db.Get("key0"); ok {
+		t.Fatalf("key0: expected deleted")
+	}
+	for i := 1; i < 500; i++ {
+		if _, ok, _ := db.Get(fmt.Sprintf("key%d", i)); !ok {
+			t.Fatalf("key%d: expected committed", i)
+		}
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	for i := 0; i < 500; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("committed"))
+	}
+	root, used, free := db.tree.Root, db.page.flushed, db.free
+
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte("aborted"))
+	}
+	for i := 0; i < 100; i++ {
+		tx.Del([]byte(fmt.Sprintf("key%d", i)))
+	}
+	tx.Abort()
+
+	if db.tree.Root != root || db.page.flushed != used || db.free.tailSeq != free.tailSeq {
+		t.Fatalf("Abort: the pager state is not restored")
+	}
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			val, ok, _ := db.Get(fmt.Sprintf("key%d", i))
+			if i < 500 && (!ok || string(val) != "committed") {
+				t.Fatalf("key%d: expected committed, got %q (%t)", i, val, ok)
+			}
+			if i >= 500 && ok {
+				t.Fatalf("key%d: expected not found", i)
+			}
+		}
+	}
+	check()
+	db.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	check()
+}
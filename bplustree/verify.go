@@ -0,0 +1,278 @@
+package bplustree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// the checksum is stored in the last bytes of the page
+func pageSetChecksum(page []byte) {
+	end := len(page) - BTREE_PAGE_TRAILER
+	sum := crc32.Checksum(page[:end], crcTable)
+	binary.LittleEndian.PutUint32(page[end:], sum)
+}
+
+func pageChecksumOK(page []byte) bool {
+	end := len(page) - BTREE_PAGE_TRAILER
+	sum := crc32.Checksum(page[:end], crcTable)
+	return binary.LittleEndian.Uint32(page[end:]) == sum
+}
+
+// a bad page found while reading or verifying the file
+type PageError struct {
+	Ptr uint64
+	Msg string
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %s", e.Ptr, e.Msg)
+}
+
+type verifier struct {
+	db     *Pager
+	errs   []error
+	owners map[uint64]string // what each page is used for
+	height int               // the depth of the leaves
+}
+
+func (v *verifier) fail(ptr uint64, format string, args ...any) {
+	v.errs = append(v.errs, &PageError{Ptr: ptr, Msg: fmt.Sprintf(format, args...)})
+}
+
+// claim a page for an owner, every page has at most one.
+func (v *verifier) claim(ptr uint64, owner string) bool {
+	if ptr == 0 || ptr >= v.db.page.flushed {
+		v.fail(ptr, "%s pointer out of bounds (%d pages)", owner, v.db.page.flushed)
+		return false
+	}
+	if prev, ok := v.owners[ptr]; ok {
+		v.fail(ptr, "used as %s and as %s", prev, owner)
+		return false
+	}
+	v.owners[ptr] = owner
+	return true
+}
+
+func (v *verifier) read(ptr uint64, owner string) (BNode, bool) {
+	if !v.claim(ptr, owner) {
+		return BNode{}, false
+	}
+	page, err := v.db.Store.ReadPage(ptr)
+	if err != nil {
+		v.fail(ptr, "%v", err)
+		return BNode{}, false
+	}
+	node := BNode{page}
+	// see Pager.pageRead() for free list nodes
+	if v.db.checksum && owner != "free list node" && !pageChecksumOK(node.Data) {
+		v.fail(ptr, "checksum mismatch")
+		return BNode{}, false
+	}
+	return node, true
+}
+
+// check the node layout without trusting the sizes stored in it
+func (v *verifier) checkLayout(ptr uint64, node BNode) bool {
+	nkeys := int(node.nkeys())
+	if nkeys == 0 {
+		v.fail(ptr, "empty node")
+		return false
+	}
+	end := v.db.tree.size.node // the space for a node
+	kvStart := HEADER + 10*nkeys
+	if node.format() == BNODE_FORMAT_PREFIX {
+		plen := int(binary.LittleEndian.Uint16(node.Data[HEADER:]))
+		if plen > BTREE_MAX_KEY_SIZE {
+			v.fail(ptr, "bad key prefix length %d", plen)
+			return false
+		}
+		kvStart = HEADER + 2 + plen + 2*nkeys
+	}
+	if kvStart > end {
+		v.fail(ptr, "%d keys do not fit in a page", nkeys)
+		return false
+	}
+	pos := kvStart
+	for i := 1; i <= nkeys; i++ {
+		if pos+4 > end {
+			v.fail(ptr, "key %d is out of the page", i-1)
+			return false
+		}
+		klen := int(binary.LittleEndian.Uint16(node.Data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.Data[pos+2:]) & VAL_LEN_MASK)
+		pos += 4 + klen + vlen
+		if pos > end {
+			v.fail(ptr, "key %d is out of the page", i-1)
+			return false
+		}
+		if kvStart+int(node.getOffset(uint16(i))) != pos {
+			v.fail(ptr, "bad offset of key %d", i)
+			return false
+		}
+		if node.btype() == BNODE_NODE && vlen != 0 {
+			v.fail(ptr, "internal node with a value at key %d", i-1)
+			return false
+		}
+	}
+	return true
+}
+
+// check a subtree, its keys must be in [lower, upper)
+func (v *verifier) checkNode(ptr uint64, depth int, lower []byte, upper []byte) {
+	node, ok := v.read(ptr, "tree node")
+	if !ok {
+		return
+	}
+	btype := node.btype()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		v.fail(ptr, "bad node type %d", btype)
+		return
+	}
+	switch node.format() {
+	case BNODE_FORMAT_PLAIN:
+	case BNODE_FORMAT_PREFIX:
+		if btype != BNODE_LEAF {
+			v.fail(ptr, "internal node in the prefix format")
+			return
+		}
+	default:
+		v.fail(ptr, "bad node format %d", node.format())
+		return
+	}
+	if !v.checkLayout(ptr, node) {
+		return
+	}
+
+	nkeys := node.nkeys()
+	if !bytes.Equal(node.GetKey(0), lower) {
+		v.fail(ptr, "first key %q does not match the parent key %q", node.GetKey(0), lower)
+	}
+	for i := uint16(1); i < nkeys; i++ {
+		if bytes.Compare(node.GetKey(i-1), node.GetKey(i)) >= 0 {
+			v.fail(ptr, "keys out of order at %d", i)
+		}
+	}
+	if upper != nil && bytes.Compare(node.GetKey(nkeys-1), upper) >= 0 {
+		v.fail(ptr, "key %q is not less than the next parent key %q", node.GetKey(nkeys-1), upper)
+	}
+
+	if btype == BNODE_LEAF {
+		for i := uint16(0); i < nkeys; i++ {
+			if node.valOverflow(i) {
+				v.checkOverflow(ptr, node.GetVal(i))
+			}
+		}
+		if v.height < 0 {
+			v.height = depth
+		} else if v.height != depth {
+			v.fail(ptr, "leaf at depth %d, expected %d", depth, v.height)
+		}
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		next := upper
+		if i+1 < nkeys {
+			next = node.GetKey(i + 1)
+		}
+		v.checkNode(node.getPtr(i), depth+1, node.GetKey(i), next)
+	}
+}
+
+// check the overflow pages of a large value
+func (v *verifier) checkOverflow(leaf uint64, ref []byte) {
+	if len(ref) != OVERFLOW_REF_SIZE {
+		v.fail(leaf, "bad overflow reference size %d", len(ref))
+		return
+	}
+	size, ptr := overflowRef(ref)
+	for npages := v.db.tree.size.overflowPages(size); npages > 0; npages-- {
+		page, ok := v.read(ptr, "overflow page")
+		if !ok {
+			return
+		}
+		if page.btype() != BNODE_OVERFLOW {
+			v.fail(ptr, "bad overflow page type %d", page.btype())
+			return
+		}
+		ptr = binary.LittleEndian.Uint64(page.Data[4:])
+	}
+}
+
+func (v *verifier) checkFreeList() {
+	fl := &v.db.free
+	if fl.tailPage == 0 {
+		if fl.headSeq != fl.tailSeq {
+			v.fail(0, "free list without nodes has %d items", fl.Total())
+		}
+		return
+	}
+
+	ptr := fl.headPage
+	for seq := fl.headSeq; ; {
+		node, ok := v.read(ptr, "free list node")
+		if !ok {
+			return
+		}
+		if btype := binary.LittleEndian.Uint16(node.Data); btype != BNODE_FREE {
+			v.fail(ptr, "bad free list node type %d", btype)
+			return
+		}
+		// the items in this node
+		for first := seq; seq < fl.tailSeq; seq++ {
+			if seq != first && fl.seq2idx(seq) == 0 {
+				break // the next node
+			}
+			v.claim(LNode(node.Data).getPtr(fl.seq2idx(seq)), "free page")
+		}
+		if ptr == fl.tailPage {
+			if seq != fl.tailSeq {
+				v.fail(ptr, "free list ends before the tail")
+			}
+			return
+		}
+		if fl.seq2idx(seq) != 0 {
+			v.fail(ptr, "free list tail %d is not reached", fl.tailPage)
+			return
+		}
+		ptr = LNode(node.Data).getNext()
+	}
+}
+
+// check the committed trees and the free list:
+// node layouts, key ordering, pointer bounds, page checksums,
+// and that every page is used exactly once.
+// the problems are returned instead of panicking.
+func (db *Pager) Verify() []error {
+	// no updates in the meantime
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	v := &verifier{db: db, owners: map[uint64]string{}, height: -1}
+	if db.tree.Root != 0 {
+		v.checkNode(db.tree.Root, 0, []byte{}, nil)
+	}
+	for _, root := range db.roots {
+		v.height = -1 // trees have different heights
+		v.checkNode(root, 0, []byte{}, nil)
+	}
+	v.checkFreeList()
+
+	// pages that are not used at all are leaked
+	leaked, first := 0, uint64(0)
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if _, ok := v.owners[ptr]; !ok {
+			if leaked == 0 {
+				first = ptr
+			}
+			leaked++
+		}
+	}
+	if leaked > 0 {
+		v.fail(first, "%d pages are not reachable", leaked)
+	}
+	return v.errs
+}
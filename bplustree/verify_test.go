@@ -0,0 +1,82 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("empty database: %v", errs)
+	}
+	for i := 0; i < 3000; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+	for i := 0; i < 3000; i += 3 {
+		db.Del([]byte(fmt.Sprintf("key%d", i)))
+	}
+	if errs := db.Verify(); len(errs) != 0 {
+		t.Fatalf("expected no problems, got %v", errs)
+	}
+	root := db.tree.Root
+	db.Close()
+
+	// flip a byte in the root node
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	buf := []byte{0}
+	offset := int64(root*BTREE_PAGE_SIZE + 100)
+	fp.ReadAt(buf, offset)
+	buf[0] ^= 0xff
+	fp.WriteAt(buf, offset)
+	fp.Close()
+
+	db = openTestPager(t, path)
+	defer db.Close()
+	errs := db.Verify()
+	if len(errs) == 0 {
+		t.Fatalf("expected a checksum mismatch")
+	}
+	perr, ok := errs[0].(*PageError)
+	if !ok || perr.Ptr != root || perr.Msg != "checksum mismatch" {
+		t.Fatalf("expected a checksum mismatch on page %d, got %v", root, errs)
+	}
+
+	// reading the bad page fails with the same error
+	if _, _, err := db.Get("key1"); !errors.As(err, &perr) || perr.Ptr != root {
+		t.Fatalf("Get: expected a *PageError for page %d, got %v", root, err)
+	}
+	err = db.Scan([]byte("key"), nil, func(key []byte, val []byte) bool { return true })
+	if !errors.As(err, &perr) || perr.Ptr != root {
+		t.Fatalf("Scan: expected a *PageError for page %d, got %v", root, err)
+	}
+}
+
+func TestVerifyBadMasterPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPager(t, path)
+	db.Set([]byte("key"), []byte("val"))
+	db.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	// the root pointer, the first commit uses the second slot
+	fp.WriteAt([]byte{0xff}, MASTER_SLOT_SIZE+20)
+	fp.Close()
+
+	db = &Pager{Path: path}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatalf("expected a bad master page")
+	}
+}
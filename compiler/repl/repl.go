@@ -2,11 +2,11 @@ package repl
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 
 	c "github.com/aidanjjenkins/compiler/compile"
@@ -17,113 +17,8 @@ import (
 
 const PROMPT = ">>> "
 
-func onStart() map[string]*vm.Tbls {
-	m := make(map[string]*vm.Tbls)
-	fileInfo, err := os.Stat(vm.TableFile)
-
-	if os.IsNotExist(err) {
-		return m
-	}
-
-	isEmpty := fileInfo.Size() == 0
-	if isEmpty {
-		return m
-	}
-	m, err = readTableData()
-	if err != nil {
-		fmt.Println("Error reading table data", err)
-		return nil
-	}
-
-	return m
-}
-
-func readTableData() (map[string]*vm.Tbls, error) {
-	file, err := os.Open(vm.TableFile)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		fmt.Println("Next offset is not withing file size", err)
-		return nil, err
-	}
-
-	fileSize := fileInfo.Size()
-	fileBytes := make([]byte, fileSize)
-	file.Read(fileBytes)
-	tables := [][]byte{}
-	for len(fileBytes) > 0 {
-		row, newFileBytes := readTableRow(fileBytes)
-		tables = append(tables, row)
-		fileBytes = newFileBytes
-	}
-
-	m := make(map[string]*vm.Tbls)
-	for _, t := range tables {
-		name := cleanse(t[c.TableMetaDataSize : c.TableMetaDataSize+c.TableNameSize])
-		idx := cleanse(t[:c.TableIndexSize])
-		cols := t[c.TableMetaDataSize+c.TableNameSize:]
-		lens := AccessTableMetaDataLengths(t)
-		colMap := make(map[string]string)
-		for i := 0; i < len(lens); i += 2 {
-			valueLength := lens[i]
-			typeLength := lens[i+1]
-
-			grouplen := valueLength + typeLength
-			group := cols[:grouplen]
-
-			colName := string(group[:valueLength])
-			colType := string(group[valueLength:])
-			colMap[colName] = colType
-
-			m[name] = &vm.Tbls{Cols: colMap, Idx: []string{}}
-			cols = cols[grouplen:]
-		}
-
-		m[name].Idx = append(m[name].Idx, idx)
-	}
-
-	return m, nil
-}
-
-func cleanse(substring []byte) string {
-	endIndex := bytes.IndexAny(substring, "\x00 \t\n\r")
-	if endIndex == -1 {
-		endIndex = len(substring)
-	}
-
-	trimmedSubstring := substring[:endIndex]
-
-	return string(trimmedSubstring)
-}
-
-func AccessTableMetaDataLengths(ins []byte) []int {
-	lens := ins[c.TableIndexSize : c.TableIndexSize+c.TableMetaDataLengths]
-	l := []int{}
-
-	for i := range lens {
-		if lens[i] != 0 {
-			l = append(l, int(lens[i]))
-		}
-	}
-
-	return l
-}
-
-func readTableRow(file []byte) ([]byte, []byte) {
-	totalLengthBuf := file[:8]
-
-	totalLength := binary.LittleEndian.Uint32(totalLengthBuf)
-	row := file[8 : totalLength+8]
-	file = file[totalLength+8:]
-	return row, file
-}
-
-func Start(in io.Reader, out io.Writer) {
-	dbInfo := onStart()
+// in read-only mode the statements that write fail and no file is created
+func Start(in io.Reader, out io.Writer, readOnly bool) {
 	scanner := bufio.NewScanner(in)
 
 	for {
@@ -136,7 +31,7 @@ func Start(in io.Reader, out io.Writer) {
 		command := scanner.Text()
 
 		if strings.HasPrefix(command, "\\") {
-			metaCommand(command, dbInfo)
+			metaCommand(command)
 		} else {
 			if string(command[len(command)-1]) != ";" {
 				fmt.Println("Missing ';'")
@@ -157,11 +52,21 @@ func Start(in io.Reader, out io.Writer) {
 					return
 				}
 
-				machine := vm.New(comp.Bytecode(), dbInfo)
+				var machine *vm.VM
+				if readOnly {
+					machine = vm.NewReadOnly(comp.Bytecode())
+				} else {
+					machine = vm.New(comp.Bytecode())
+				}
 				err = machine.Run()
+				if cerr := machine.Close(); cerr != nil && err == nil {
+					err = cerr
+				}
+				// a failed statement changes nothing, like a write
+				// in read-only mode or on a locked database
 				if err != nil {
-					fmt.Println("Error running")
-					return
+					fmt.Println("Error running: ", err)
+					continue
 				}
 
 				fmt.Println(">>> Executed.")
@@ -171,25 +76,117 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
-func dTable(info map[string]*vm.Tbls, tName string) {
-	data, ok := info[tName]
-	if !ok {
-		fmt.Println("Table name not found")
+// the meta commands only read
+func openPool() *vm.Pool {
+	pool, err := vm.OpenPool(vm.IdxFile, true)
+	if err != nil {
+		fmt.Println("Error opening index: ", err)
+		return nil
+	}
+	return pool
+}
+
+func dTable(tName string) {
+	pool := openPool()
+	if pool == nil {
+		return
+	}
+	defer pool.Close()
+
+	machine := &vm.VM{Pool: pool}
+	data, err := machine.FindTable(tName)
+	if err != nil {
+		fmt.Println(">>> ", err)
 		return
 	}
 
+	// name | type | index | unique | primary key |
+	decoded := vm.DecodeBytes(data)[1:]
 	var cols [][]string
-	for k, v := range data.Cols {
+	idx := []string{}
+	for i := 0; i+5 <= len(decoded); i += 5 {
 		var kv []string
-		kv = append(kv, k)
-		kv = append(kv, v)
+		kv = append(kv, decoded[i])
+		kv = append(kv, decoded[i+1])
 
 		cols = append(cols, kv)
+		if decoded[i+2] == "true" {
+			idx = append(idx, decoded[i])
+		}
 	}
 
 	mWidths := calculateMaxWidths(cols)
 	printTable(cols, mWidths)
-	fmt.Println("indexes: ", data.Idx)
+	fmt.Println("indexes: ", idx)
+}
+
+func verifyIndex() {
+	pool := openPool()
+	if pool == nil {
+		return
+	}
+	defer pool.Close()
+
+	errs := pool.Verify()
+	for _, err := range errs {
+		fmt.Println(">>> ", err)
+	}
+	fmt.Printf(">>> %s: %d problems found\n", vm.IdxFile, len(errs))
+}
+
+func indexStats() {
+	pool := openPool()
+	if pool == nil {
+		return
+	}
+	defer pool.Close()
+
+	stats, err := pool.Stats()
+	if err != nil {
+		fmt.Println(">>> ", err)
+		return
+	}
+	fmt.Printf(">>> %s: %d bytes, %d pages of %d bytes, %d free, %d free list pages\n",
+		vm.IdxFile, stats.FileSize, stats.Pages, stats.PageSize, stats.FreePages, stats.FreeNodes)
+	rows := [][]string{{"tree", "height", "internal", "leaves", "keys", "overflow", "fill"}}
+	names := make([]string, 0, len(stats.Trees))
+	for name := range stats.Trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ts := stats.Trees[name]
+		if name == "" {
+			name = "(default)"
+		}
+		rows = append(rows, []string{
+			name, strconv.Itoa(ts.Height), strconv.Itoa(ts.Internal), strconv.Itoa(ts.Leaves),
+			strconv.Itoa(ts.Keys), strconv.Itoa(ts.Overflow),
+			fmt.Sprintf("%.1f%%", 100*ts.Fill(stats.PageSize)),
+		})
+	}
+	printTable(rows, calculateMaxWidths(rows))
+}
+
+func dumpIndex() {
+	pool := openPool()
+	if pool == nil {
+		return
+	}
+	defer pool.Close()
+
+	if err := pool.Dump(os.Stdout); err != nil {
+		fmt.Println(">>> ", err)
+	}
+}
+
+// writers are only blocked while the index and the tables are copied
+func backup(dir string) {
+	if err := vm.Backup(dir); err != nil {
+		fmt.Println(">>> Backup failed: ", err)
+		return
+	}
+	fmt.Printf(">>> Backed up to %s\n", dir)
 }
 
 func calculateMaxWidths(data [][]string) []int {
@@ -225,7 +222,7 @@ func printTable(data [][]string, maxWidths []int) {
 	}
 }
 
-func metaCommand(c string, tableInfo map[string]*vm.Tbls) {
+func metaCommand(c string) {
 	cmd := strings.Split(c, " ")
 	switch cmd[0] {
 	case "\\q":
@@ -233,7 +230,23 @@ func metaCommand(c string, tableInfo map[string]*vm.Tbls) {
 		os.Exit(0)
 	case "\\d":
 		fmt.Println("table: ", cmd[1])
-		dTable(tableInfo, cmd[1])
+		dTable(cmd[1])
+		return
+	case "\\verify":
+		verifyIndex()
+		return
+	case "\\stats":
+		indexStats()
+		return
+	case "\\dump":
+		dumpIndex()
+		return
+	case "\\backup":
+		if len(cmd) != 2 {
+			fmt.Println(">>> Usage: \\backup <path>")
+			return
+		}
+		backup(cmd[1])
 		return
 	default:
 		fmt.Println(">>> Unknown meta command:", cmd)
@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	c "github.com/aidanjjenkins/compiler/compile"
+)
+
+// copy the index and the data files to a directory, the copy can be opened
+// in place of the original. writers are only blocked while the index and
+// the tables are copied. the rows file is copied after that, up to its size
+// at the time: rows are only appended and the copied index doesn't point
+// past that size.
+func Backup(dir string) error {
+	src, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	dst, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return errors.New("backup: the destination is the database directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	rows, err := backupSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	if err := backupRows(dir, rows); err != nil {
+		return err
+	}
+	// a log left in the directory would be replayed over the copy
+	if err := os.Remove(filepath.Join(dir, WalFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nil
+}
+
+// copy the index and the tables under the shared lock, which keeps writers
+// out. the tables are small and updated in place, so they are copied whole.
+// returns the size of the rows file, -1 if there is none.
+func backupSnapshot(dir string) (int64, error) {
+	machine := NewReadOnly(&c.Bytecode{})
+	defer machine.Close()
+	if machine.err != nil {
+		return 0, machine.err
+	}
+
+	err := backupFile(filepath.Join(dir, IdxFile), machine.Pool.db.Backup)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(TableFile)
+	if err == nil {
+		err = backupFile(filepath.Join(dir, TableFile), func(w io.Writer) error {
+			_, err := io.Copy(w, file)
+			return err
+		})
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+
+	fi, err := os.Stat(RowsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+// copy the first bytes of the rows file, the lock is not needed
+func backupRows(dir string, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	file, err := os.Open(RowsFile)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer file.Close()
+	return backupFile(filepath.Join(dir, RowsFile), func(w io.Writer) error {
+		_, err := io.CopyN(w, file, size)
+		return err
+	})
+}
+
+// write a file and make it durable
+func backupFile(path string, write func(w io.Writer) error) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer fp.Close()
+	if err := write(fp); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "github.com/aidanjjenkins/compiler/compile"
+)
+
+func TestBackup(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");").Close()
+	if err := Backup("."); err == nil {
+		t.Fatalf("backed up over the database")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, WalFile), []byte("stale"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := Backup(dir); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	// the copy is opened in place of the original
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+	backup := New(&c.Bytecode{})
+	defer backup.Close()
+	if errs := backup.Pool.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	checkRecovered(t, backup)
+}
+
+// a statement can run while the rows are copied, its rows are not copied
+func TestBackupWriter(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");").Close()
+	dir := t.TempDir()
+	size, err := backupSnapshot(dir)
+	if err != nil {
+		t.Fatalf("backupSnapshot: %v", err)
+	}
+	runStatement(t, "INSERT INTO dogs VALUES (\"max\", \"lab\");").Close()
+	if err := backupRows(dir, size); err != nil {
+		t.Fatalf("backupRows: %v", err)
+	}
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+	backup := New(&c.Bytecode{})
+	defer backup.Close()
+	if errs := backup.Pool.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+	checkRecovered(t, backup)
+}
@@ -0,0 +1,306 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aidanjjenkins/compiler/code"
+)
+
+// ------------------------------------------------
+// trees of the index file
+//  tree      key                                 value
+//  tables    table name                          offset in tables.db
+//            index:<table>:<cols>                index id, an index of the table
+//  indexes   index id | column values | row id   offset in rows.db
+// ------------------------------------------------
+// the catalog and the index entries are in their own trees, so a column
+// value can't collide with a table name. all the indexes share a tree,
+// the keys of an index start with its id so they can't collide with the
+// same values in another index. the number of indexes is not limited by
+// the catalog of named trees in the master page.
+// <cols> are the indexed columns in order, separated by ','.
+// names are identifiers, they can't contain ':' or ','.
+//
+// the index id is 4 bytes big endian, the first index has id 1.
+// each column value is escaped and terminated, so the keys sort by the
+// first value, then by the next one, and the keys of a value start with
+// the same bytes, see Lookup(). the row id is the offset of the row in
+// rows.db, big endian so the rows of the same values are in order.
+
+const CatalogTree = "tables"
+const IndexTree = "indexes"
+
+var ErrUpgradeNeeded = errors.New("the index file has the old layout, open the database for writing first")
+
+// the key of the index on some columns in the catalog
+func indexDef(tName string, cols []string) string {
+	return "index:" + tName + ":" + strings.Join(cols, ",")
+}
+
+// append a column value to a key, 0x00 and 0x01 are escaped
+// so that 0x00 only ends the value.
+func appendKeyValue(key []byte, val string) []byte {
+	for i := 0; i < len(val); i++ {
+		switch val[i] {
+		case 0x00, 0x01:
+			key = append(key, 0x01, val[i]+1)
+		default:
+			key = append(key, val[i])
+		}
+	}
+	return append(key, 0x00)
+}
+
+func indexKey(id uint32, vals []string, rowID uint32) []byte {
+	key := binary.BigEndian.AppendUint32(nil, id)
+	for _, val := range vals {
+		key = appendKeyValue(key, val)
+	}
+	return binary.BigEndian.AppendUint32(key, rowID)
+}
+
+type index struct {
+	cols []string
+	id   uint32
+}
+
+// the indexes on a table in the order of their columns
+func (p *Pool) indexes(tName string) ([]index, error) {
+	prefix := "index:" + tName + ":"
+	// the next byte after ':'
+	end := "index:" + tName + ";"
+	indexes := []index{}
+	err := p.db.Tree(CatalogTree).Scan([]byte(prefix), []byte(end), func(key []byte, val []byte) bool {
+		if len(val) == 4 {
+			cols := strings.Split(string(key[len(prefix):]), ",")
+			indexes = append(indexes, index{cols: cols, id: binary.LittleEndian.Uint32(val)})
+		}
+		return true
+	})
+	return indexes, err
+}
+
+// the column lists of the indexes on a table
+func (p *Pool) Indexes(tName string) ([][]string, error) {
+	indexes, err := p.indexes(tName)
+	if err != nil {
+		return nil, err
+	}
+	cols := [][]string{}
+	for _, idx := range indexes {
+		cols = append(cols, idx.cols)
+	}
+	return cols, nil
+}
+
+// the id of the index on the columns, 0 if there is none
+func (p *Pool) indexID(tName string, cols []string) (uint32, error) {
+	val, found, err := p.db.Tree(CatalogTree).Get([]byte(indexDef(tName, cols)))
+	if err != nil || !found || len(val) != 4 {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(val), nil
+}
+
+// the largest index id in the catalog
+func (p *Pool) maxIndexID() (uint32, error) {
+	maxID := uint32(0)
+	err := p.db.Tree(CatalogTree).Scan([]byte("index:"), []byte("index;"), func(key []byte, val []byte) bool {
+		if len(val) == 4 {
+			maxID = max(maxID, binary.LittleEndian.Uint32(val))
+		}
+		return true
+	})
+	return maxID, err
+}
+
+// the rows of an index with the values of its first columns, in the order
+// of the values of the other columns, then of the rows. values are not
+// unique, any number of rows can have the same values.
+func (p *Pool) Lookup(tName string, cols []string, vals []string) ([]uint32, error) {
+	if len(vals) == 0 || len(vals) > len(cols) {
+		return nil, nil
+	}
+	id, err := p.indexID(tName, cols)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	start := indexKey(id, vals, 0)
+	start = start[:len(start)-4]
+	// the keys of the values end with 0x00 and more
+	end := append(start[:len(start)-1:len(start)-1], 0x01)
+	offsets := []uint32{}
+	err = p.db.Tree(IndexTree).Scan(start, end, func(key []byte, val []byte) bool {
+		offsets = append(offsets, binary.LittleEndian.Uint32(val))
+		return true
+	})
+	return offsets, err
+}
+
+// the index with the most leading columns in the WHERE columns and the
+// number of those columns, 0 if no index applies. an index is only used
+// if its columns are flagged in the table.
+func (vm *VM) chooseIndex(tName string, cells []*code.ColCell, where []string) ([]string, int, error) {
+	flagged := map[string]bool{}
+	for _, cell := range cells {
+		flagged[cell.Name] = cell.Index
+	}
+	indexes, err := vm.Pool.Indexes(tName)
+	if err != nil {
+		return nil, 0, err
+	}
+	best, bestN := []string(nil), 0
+	for _, cols := range indexes {
+		n := 0
+		for n < len(cols) && flagged[cols[n]] && slices.Contains(where, cols[n]) {
+			n++
+		}
+		if n > bestN {
+			best, bestN = cols, n
+		}
+	}
+	return best, bestN, nil
+}
+
+// look up the rows with the WHERE values of the first n columns of the
+// index, then check all the conditions. the rows are pushed in file order,
+// like a scan.
+func (vm *VM) indexSearch(tName string, index []string, n int, idxs []int, cols []string, vals []string) error {
+	key := []string{}
+	for _, col := range index[:n] {
+		key = append(key, vals[slices.Index(cols, col)])
+	}
+	offsets, err := vm.Pool.Lookup(tName, index, key)
+	if err != nil {
+		return err
+	}
+	slices.Sort(offsets)
+	for _, offset := range offsets {
+		row, err := readRow(int64(offset), RowsFile)
+		if err != nil {
+			return fmt.Errorf("Error reading row: %w", err)
+		}
+		decoded := DecodeBytes(row)
+		if decoded[0] != tName || !searchRow(idxs, decoded[1:], vals) {
+			continue
+		}
+		vm.push(&code.FoundRow{Val: decoded[1:]})
+	}
+	return nil
+}
+
+// the positions of the columns in a decoded row, after the table name.
+// -1 for a column that is not in the table.
+func getColPositions(cells []*code.ColCell, cols []string) []int {
+	pos := []int{}
+	for _, col := range cols {
+		pos = append(pos, -1)
+		for i, cell := range cells {
+			if cell.Name == col {
+				pos[len(pos)-1] = 1 + i
+				break
+			}
+		}
+	}
+	return pos
+}
+
+// add a new row to every index of its table, in the statement that
+// writes the row. row is the decoded row with the table name.
+// the row is not written if a key is too large.
+func (vm *VM) indexRow(tName string, cells []*code.ColCell, row []string, offset uint32) error {
+	indexes, err := vm.Pool.indexes(tName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		vals := []string{}
+		for _, pos := range getColPositions(cells, idx.cols) {
+			if pos < 0 || pos >= len(row) {
+				vals = append(vals, " ") // like a missing value, see DecodeBytes()
+			} else {
+				vals = append(vals, row[pos])
+			}
+		}
+		if err := vm.addIndexKey(idx.id, vals, offset); err != nil {
+			return fmt.Errorf("index on %s (%s): %w", tName, strings.Join(idx.cols, ", "), err)
+		}
+	}
+	return nil
+}
+
+// files written before the catalog tree have the tables and the index
+// entries in the default tree, with bare column values as keys.
+func (p *Pool) legacyKeys() (map[string]uint32, error) {
+	keys := map[string]uint32{}
+	err := p.db.Scan([]byte{}, nil, func(key []byte, val []byte) bool {
+		if len(val) == 4 {
+			keys[string(key)] = binary.LittleEndian.Uint32(val)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// move the tables of an old index file to the catalog and rebuild the
+// indexes in a statement, then drop the old keys. the old keys are only
+// dropped after the statement commits, a crash in between upgrades again.
+func (vm *VM) upgradeIndex() error {
+	legacy, err := vm.Pool.legacyKeys()
+	if err != nil {
+		return fmt.Errorf("upgrade index: %w", err)
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	// index entries point into rows.db, not at a table of the same name
+	names := []string{}
+	for key, offset := range legacy {
+		row, err := readRow(int64(offset), TableFile)
+		if err == nil && getTableName(row) == key {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	for _, tName := range names {
+		offset := legacy[tName]
+		vm.addTable(tName, offset)
+		row, _ := readRow(int64(offset), TableFile)
+		decoded := DecodeBytes(row)
+		// an index on each flagged column, like the old entries
+		for _, cell := range getColInfo(decoded[1:]) {
+			if !cell.Index {
+				continue
+			}
+			cols := []string{cell.Name}
+			id, err := vm.addIndexDef(tName, cols)
+			if err != nil {
+				return vm.abort(fmt.Errorf("upgrade index: %w", err))
+			}
+			if count := DecodeTableCount(row); count > 0 {
+				err := vm.addExistingRowsToIndex(tName, id, getColPositions(getColInfo(decoded[1:]), cols), count)
+				if err != nil {
+					return vm.abort(fmt.Errorf("upgrade index: %w", err))
+				}
+			}
+		}
+	}
+	if err := vm.commit(); err != nil {
+		return fmt.Errorf("upgrade index: %w", err)
+	}
+
+	tx := vm.Pool.db.Begin()
+	for key := range legacy {
+		if _, err := tx.Del([]byte(key)); err != nil {
+			tx.Abort()
+			return fmt.Errorf("upgrade index: %w", err)
+		}
+	}
+	return tx.Commit()
+}
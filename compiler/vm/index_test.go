@@ -0,0 +1,644 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	tree "github.com/aidanjjenkins/bplustree"
+	"github.com/aidanjjenkins/compiler/code"
+	c "github.com/aidanjjenkins/compiler/compile"
+)
+
+func TestIndexKeyOrder(t *testing.T) {
+	// in the order of the values, then of the rows
+	keys := [][]byte{
+		indexKey(1, []string{""}, 7),
+		indexKey(1, []string{"\x00"}, 1),
+		indexKey(1, []string{"\x00\x00"}, 1),
+		indexKey(1, []string{"\x01"}, 1),
+		indexKey(1, []string{"a"}, 1),
+		indexKey(1, []string{"a"}, 2),
+		indexKey(1, []string{"a\x00"}, 1),
+		indexKey(1, []string{"ab"}, 0),
+		indexKey(1, []string{"b"}, 0),
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("key %d %q is not before %q", i-1, keys[i-1], keys[i])
+		}
+	}
+	// by the index first
+	if bytes.Compare(indexKey(1, []string{"b"}, 9), indexKey(2, []string{""}, 0)) >= 0 {
+		t.Fatalf("the key is not in the order of the index ids")
+	}
+	// a value is not a prefix of the keys of another value
+	if bytes.HasPrefix(indexKey(1, []string{"ab"}, 0), appendKeyValue(binary.BigEndian.AppendUint32(nil, 1), "a")) {
+		t.Fatalf("the value is not terminated")
+	}
+
+	// by the first value, then by the next one
+	keys = [][]byte{
+		indexKey(1, []string{"a", ""}, 9),
+		indexKey(1, []string{"a", "b"}, 1),
+		indexKey(1, []string{"a", "b"}, 2),
+		indexKey(1, []string{"a", "b\x00"}, 0),
+		indexKey(1, []string{"a", "c"}, 0),
+		indexKey(1, []string{"a\x00", "a"}, 0),
+		indexKey(1, []string{"ab", ""}, 0),
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("key %d %q is not before %q", i-1, keys[i-1], keys[i])
+		}
+	}
+}
+
+// tables with the same values don't share index entries
+func TestIndexKeyspace(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE dogs (name varchar, breed varchar);",
+		"CREATE TABLE cats (name varchar, breed varchar);",
+		"INSERT INTO dogs VALUES (\"cats\", \"mutt\");",
+		"INSERT INTO cats VALUES (\"cats\", \"tabby\");",
+		"CREATE INDEX ON dogs (name);",
+		"CREATE INDEX ON cats (name);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+
+	machine := New(&c.Bytecode{})
+	defer machine.Close()
+	// a value that is a table name
+	offset, ok, _ := machine.Pool.Search("cats")
+	if row, err := readRow(int64(offset), TableFile); !ok || err != nil || getTableName(row) != "cats" {
+		t.Fatalf("the table was replaced: %v", err)
+	}
+	for tName, breed := range map[string]string{"dogs": "mutt", "cats": "tabby"} {
+		offsets, err := machine.Pool.Lookup(tName, []string{"name"}, []string{"cats"})
+		if err != nil || len(offsets) != 1 {
+			t.Fatalf("%s: %d entries", tName, len(offsets))
+		}
+		row, err := readRow(int64(offsets[0]), RowsFile)
+		if decoded := DecodeBytes(row); err != nil || decoded[2] != breed {
+			t.Fatalf("%s: got %v (%v)", tName, decoded, err)
+		}
+	}
+}
+
+// every row of a value, and only those
+func TestIndexLookup(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE dogs (name varchar, breed varchar);",
+		"INSERT INTO dogs VALUES (\"winnie\", \"lab\");",
+		"INSERT INTO dogs VALUES (\"stella\", \"labrador\");",
+		"INSERT INTO dogs VALUES (\"rex\", \"la\");",
+		"INSERT INTO dogs VALUES (\"max\", \"lab\");",
+		"CREATE INDEX ON dogs (breed);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+
+	machine := New(&c.Bytecode{})
+	defer machine.Close()
+	expected := map[string][]string{"lab": {"winnie", "max"}, "la": {"rex"}, "labrador": {"stella"}, "l": nil}
+	for breed, names := range expected {
+		offsets, err := machine.Pool.Lookup("dogs", []string{"breed"}, []string{breed})
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		got := []string{}
+		for _, offset := range offsets {
+			row, err := readRow(int64(offset), RowsFile)
+			if err != nil {
+				t.Fatalf("readRow: %v", err)
+			}
+			got = append(got, DecodeBytes(row)[1])
+		}
+		if !slices.Equal(got, names) && len(got)+len(names) > 0 {
+			t.Fatalf("%s: got %v, expected %v", breed, got, names)
+		}
+	}
+}
+
+// the tables and index entries of older files are in the default tree
+func TestIndexUpgrade(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE dogs (name varchar, breed varchar);",
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\");",
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");",
+		"CREATE INDEX ON dogs (breed);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+	machine := New(&c.Bytecode{})
+	tableOffset, _, _ := machine.Pool.Search("dogs")
+	rows := map[string]uint32{}
+	machine.Pool.db.Tree(IndexTree).Scan([]byte{}, nil, func(key []byte, val []byte) bool {
+		row, _ := readRow(int64(binary.LittleEndian.Uint32(val)), RowsFile)
+		rows[DecodeBytes(row)[2]] = binary.LittleEndian.Uint32(val)
+		return true
+	})
+	machine.Close()
+
+	// the old layout
+	os.Remove(IdxFile)
+	db := &tree.Pager{Path: IdxFile}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	rows["dogs"] = tableOffset
+	for key, offset := range rows {
+		db.Set([]byte(key), binary.LittleEndian.AppendUint32(nil, offset))
+	}
+	db.Close()
+
+	machine = NewReadOnly(&c.Bytecode{})
+	if err := machine.Run(); !errors.Is(err, ErrUpgradeNeeded) {
+		t.Fatalf("expected ErrUpgradeNeeded, got %v", err)
+	}
+	machine.Close()
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if legacy, err := machine.Pool.legacyKeys(); err != nil || len(legacy) != 0 {
+		t.Fatalf("the old keys are left")
+	}
+	if offset, ok, _ := machine.Pool.Search("dogs"); !ok || offset != tableOffset {
+		t.Fatalf("dogs: got %d (%t), expected %d", offset, ok, tableOffset)
+	}
+	id, err := machine.Pool.indexID("dogs", []string{"breed"})
+	if err != nil || id == 0 {
+		t.Fatalf("no index id: %v", err)
+	}
+	for _, breed := range []string{"cane corso", "mutt"} {
+		key := indexKey(id, []string{breed}, rows[breed])
+		if _, ok, _ := machine.Pool.db.Tree(IndexTree).Get(key); !ok {
+			t.Fatalf("%s is not in the index", breed)
+		}
+	}
+	if indexes, _ := machine.Pool.Indexes("dogs"); len(indexes) != 1 || !slices.Equal(indexes[0], []string{"breed"}) {
+		t.Fatalf("indexes: %v", indexes)
+	}
+	if errs := machine.Pool.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE wishlist (name varchar, brand varchar, price varchar);",
+		"CREATE TABLE wish (name varchar);",
+		"INSERT INTO wishlist VALUES (\"4090\", \"nvidia\", \"1600\");",
+		"INSERT INTO wishlist VALUES (\"4080\", \"nvidia\", \"1000\");",
+		"INSERT INTO wishlist VALUES (\"4090\", \"asus\", \"2000\");",
+		"INSERT INTO wishlist VALUES (\"4090\", \"msi\", \"1600\");",
+		"CREATE INDEX ON wishlist (name, price);",
+		"CREATE INDEX ON wishlist (brand);",
+		"CREATE INDEX ON wish (name);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+	// a column that is not in the table fails the whole statement
+	machine := New(compileStatement(t, "CREATE INDEX ON wishlist (name, color);"))
+	if err := machine.Run(); err == nil {
+		t.Fatalf("expected an error for a missing column")
+	}
+	machine.Close()
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	// in the order of the names, not of the other table
+	indexes, err := machine.Pool.Indexes("wishlist")
+	if err != nil || len(indexes) != 2 || !slices.Equal(indexes[0], []string{"brand"}) || !slices.Equal(indexes[1], []string{"name", "price"}) {
+		t.Fatalf("indexes: %v", indexes)
+	}
+
+	brands := func(offsets []uint32, err error) []string {
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		got := []string{}
+		for _, offset := range offsets {
+			row, err := readRow(int64(offset), RowsFile)
+			if err != nil {
+				t.Fatalf("readRow: %v", err)
+			}
+			got = append(got, DecodeBytes(row)[2])
+		}
+		return got
+	}
+	cols := []string{"name", "price"}
+	tests := []struct {
+		vals     []string
+		expected []string
+	}{
+		{[]string{"4090", "1600"}, []string{"nvidia", "msi"}},
+		{[]string{"4090", "2000"}, []string{"asus"}},
+		{[]string{"4090", "1000"}, []string{}},
+		// by the name alone, in the order of the prices
+		{[]string{"4090"}, []string{"nvidia", "msi", "asus"}},
+		{[]string{"4080"}, []string{"nvidia"}},
+		{[]string{"40"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := brands(machine.Pool.Lookup("wishlist", cols, tt.vals)); !slices.Equal(got, tt.expected) {
+			t.Fatalf("%v: got %v, expected %v", tt.vals, got, tt.expected)
+		}
+	}
+	if got := brands(machine.Pool.Lookup("wishlist", []string{"price", "name"}, []string{"1600"})); len(got) != 0 {
+		t.Fatalf("not an index: got %v", got)
+	}
+}
+
+// the rows found by a SELECT, in the order they are pushed
+func selectRows(t *testing.T, machine *VM, tName string, where [][2]string) [][]string {
+	machine.push(&code.TableName{Value: tName})
+	for _, w := range where {
+		machine.push(&code.Where{Column: w[0], Value: w[1]})
+	}
+	if err := machine.executeRowSearch(len(where) + 1); err != nil {
+		t.Fatalf("SELECT: %v", err)
+	}
+	rows := [][]string{}
+	for i := 0; i < machine.sp; i++ {
+		rows = append(rows, machine.Stack[i].(*code.FoundRow).Val)
+	}
+	machine.sp = 0
+	return rows
+}
+
+func TestSelectIndex(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE wishlist (name varchar, brand varchar, price varchar);",
+		"INSERT INTO wishlist VALUES (\"4090\", \"nvidia\", \"1600\");",
+		"INSERT INTO wishlist VALUES (\"4080\", \"nvidia\", \"1000\");",
+		"INSERT INTO wishlist VALUES (\"4090\", \"asus\", \"2000\");",
+		"INSERT INTO wishlist VALUES (\"4090\", \"msi\", \"1600\");",
+		"CREATE INDEX ON wishlist (name, price);",
+		"CREATE INDEX ON wishlist (brand);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+
+	machine := New(&c.Bytecode{})
+	defer machine.Close()
+	tableRow, err := machine.FindTable("wishlist")
+	if err != nil {
+		t.Fatalf("FindTable: %v", err)
+	}
+	table := DecodeBytes(tableRow)[1:]
+	tests := []struct {
+		where [][2]string
+		index []string
+		n     int
+		found int
+	}{
+		{[][2]string{{"name", "4090"}, {"price", "1600"}}, []string{"name", "price"}, 2, 2},
+		{[][2]string{{"price", "1600"}, {"name", "4090"}}, []string{"name", "price"}, 2, 2},
+		{[][2]string{{"name", "4090"}}, []string{"name", "price"}, 1, 3},
+		{[][2]string{{"name", "4090"}, {"brand", "asus"}}, []string{"brand"}, 1, 1},
+		{[][2]string{{"brand", "nvidia"}}, []string{"brand"}, 1, 2},
+		{[][2]string{{"brand", "intel"}}, []string{"brand"}, 1, 0},
+		// not the first column of an index
+		{[][2]string{{"price", "1600"}}, nil, 0, 2},
+	}
+	for _, tt := range tests {
+		cols := []string{}
+		vals := []string{}
+		for _, w := range tt.where {
+			cols = append(cols, w[0])
+			vals = append(vals, w[1])
+		}
+		index, n, err := machine.chooseIndex("wishlist", getColInfo(table), cols)
+		if err != nil || n != tt.n || !slices.Equal(index, tt.index) {
+			t.Fatalf("%v: chose %v with %d columns", tt.where, index, n)
+		}
+
+		// the same rows as a scan
+		got := selectRows(t, machine, "wishlist", tt.where)
+		names := []string{}
+		for i := 0; i < len(table); i += 5 {
+			names = append(names, table[i])
+		}
+		machine.walkTable(RowsFile, "wishlist", getColIdxFromTable(names, cols), vals)
+		scanned := [][]string{}
+		for i := 0; i < machine.sp; i++ {
+			scanned = append(scanned, machine.Stack[i].(*code.FoundRow).Val)
+		}
+		machine.sp = 0
+		if len(got) != tt.found || !slices.EqualFunc(got, scanned, slices.Equal[[]string]) {
+			t.Fatalf("%v: got %v, the scan found %v", tt.where, got, scanned)
+		}
+	}
+}
+
+// the rows of a table by the index on the columns, compared with a scan
+func checkIndex(t *testing.T, machine *VM, tName string, cols []string) {
+	tableRow, err := machine.FindTable(tName)
+	if err != nil {
+		t.Fatalf("FindTable: %v", err)
+	}
+	table := DecodeBytes(tableRow)
+	pos := getColPositions(getColInfo(table[1:]), cols)
+	id, err := machine.Pool.indexID(tName, cols)
+	if err != nil || id == 0 {
+		t.Fatalf("%s %v: no index id: %v", tName, cols, err)
+	}
+	expected := map[string]bool{}
+	for offset := int64(0); ; {
+		row, err := readRow(offset, RowsFile)
+		if err != nil {
+			break
+		}
+		if decoded := DecodeBytes(row); decoded[0] == tName {
+			vals := []string{}
+			for _, p := range pos {
+				vals = append(vals, decoded[p])
+			}
+			expected[string(indexKey(id, vals, uint32(offset)))] = true
+		}
+		offset += 8 + int64(len(row))
+	}
+
+	got := map[string]bool{}
+	start := binary.BigEndian.AppendUint32(nil, id)
+	end := binary.BigEndian.AppendUint32(nil, id+1)
+	machine.Pool.db.Tree(IndexTree).Scan(start, end, func(key []byte, val []byte) bool {
+		got[string(key)] = true
+		return true
+	})
+	if !maps.Equal(got, expected) {
+		t.Fatalf("%s %v: %d keys in the index, %d rows", tName, cols, len(got), len(expected))
+	}
+}
+
+// the leaves of the index tree in key order, as printed by Dump()
+func indexLeaves(t *testing.T, machine *VM) []string {
+	var buf bytes.Buffer
+	if err := machine.Pool.db.Dump(&buf); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	leaves := []string{}
+	inIndex := false
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "tree ") {
+			inIndex = line == fmt.Sprintf("tree %q", IndexTree)
+		} else if inIndex && strings.Contains(line, "leaf ") {
+			leaves = append(leaves, strings.TrimSpace(line))
+		}
+	}
+	return leaves
+}
+
+// a new index is merged into the index tree, the pages of the other
+// indexes are kept
+func TestCreateIndexKeepsPages(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar);").Close()
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("%s%c%c", strings.Repeat("winnie", 16), 'a'+i/26, 'a'+i%26)
+		runStatement(t, fmt.Sprintf("INSERT INTO dogs VALUES (\"%s\", \"lab\");", name)).Close()
+	}
+	runStatement(t, "CREATE INDEX ON dogs (name);").Close()
+
+	machine := New(&c.Bytecode{})
+	before := indexLeaves(t, machine)
+	machine.Close()
+	if len(before) < 3 {
+		t.Fatalf("%d leaves in the index", len(before))
+	}
+
+	runStatement(t, "CREATE INDEX ON dogs (breed);").Close()
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkIndex(t, machine, "dogs", []string{"name"})
+	checkIndex(t, machine, "dogs", []string{"breed"})
+	after := indexLeaves(t, machine)
+	// the keys of the new index go to the last leaf
+	for _, leaf := range before[:len(before)-1] {
+		if !slices.Contains(after, leaf) {
+			t.Fatalf("the leaf was rewritten: %s", leaf)
+		}
+	}
+}
+
+// a second index on the same columns would orphan the keys of the first
+func TestDuplicateIndex(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"INSERT INTO dogs VALUES (\"stella\", \"lab\"); "+
+		"INSERT INTO dogs VALUES (\"max\", \"lab\"); "+
+		"CREATE INDEX ON dogs (breed);").Close()
+	for _, stmt := range []string{
+		"CREATE INDEX ON dogs (breed);",
+		// the first one is created
+		"CREATE INDEX ON dogs (name); CREATE INDEX ON dogs (name);",
+	} {
+		machine := New(compileStatement(t, stmt))
+		if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("%s: expected an error, got %v", stmt, err)
+		}
+		machine.Close()
+	}
+
+	machine := New(&c.Bytecode{})
+	defer machine.Close()
+	checkIndex(t, machine, "dogs", []string{"breed"})
+	checkIndex(t, machine, "dogs", []string{"name"})
+	n := 0
+	machine.Pool.db.Tree(IndexTree).Scan([]byte{}, []byte{0xff}, func(key []byte, val []byte) bool {
+		n++
+		return true
+	})
+	if n != 6 {
+		t.Fatalf("%d keys in the index, expected 6", n)
+	}
+}
+
+func TestInsertIndex(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE dogs (name varchar, breed varchar, age varchar);",
+		"CREATE TABLE cats (name varchar, breed varchar);",
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\", \"3\");",
+		// on existing rows and on an empty table
+		"CREATE INDEX ON dogs (breed, age);",
+		"CREATE INDEX ON dogs (name);",
+		"CREATE INDEX ON cats (breed);",
+		"INSERT INTO dogs VALUES (\"stella\", \"lab\", \"5\");",
+		"INSERT INTO dogs (name, breed) VALUES (\"max\", \"lab\");",
+		"INSERT INTO dogs (age, name, breed) VALUES (\"5\", \"rex\", \"lab\");",
+		"INSERT INTO cats VALUES (\"tom\", \"tabby\");",
+	} {
+		runStatement(t, stmt).Close()
+	}
+
+	machine := New(&c.Bytecode{})
+	checkIndex(t, machine, "dogs", []string{"breed", "age"})
+	checkIndex(t, machine, "dogs", []string{"name"})
+	checkIndex(t, machine, "cats", []string{"breed"})
+	names := func(rows [][]string) []string {
+		got := []string{}
+		for _, row := range rows {
+			got = append(got, row[0])
+		}
+		return got
+	}
+	if got := names(selectRows(t, machine, "dogs", [][2]string{{"breed", "lab"}})); !slices.Equal(got, []string{"stella", "max", "rex"}) {
+		t.Fatalf("lab: got %v", got)
+	}
+	if got := names(selectRows(t, machine, "dogs", [][2]string{{"breed", "lab"}, {"age", "5"}})); !slices.Equal(got, []string{"stella", "rex"}) {
+		t.Fatalf("lab, 5: got %v", got)
+	}
+	if got := names(selectRows(t, machine, "cats", [][2]string{{"breed", "tabby"}})); !slices.Equal(got, []string{"tom"}) {
+		t.Fatalf("tabby: got %v", got)
+	}
+	machine.Close()
+
+	// the row and its index keys are replayed together
+	crash(runStatement(t, "INSERT INTO dogs VALUES (\"bella\", \"lab\", \"1\");"))
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkIndex(t, machine, "dogs", []string{"breed", "age"})
+	checkIndex(t, machine, "dogs", []string{"name"})
+	if got := names(selectRows(t, machine, "dogs", [][2]string{{"name", "bella"}})); !slices.Equal(got, []string{"bella"}) {
+		t.Fatalf("bella: got %v", got)
+	}
+}
+
+// a bad page of the index fails the statements that read it
+func TestIndexBadPage(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"mutt\"); "+
+		"CREATE INDEX ON dogs (breed);").Close()
+
+	// flip a byte in each page after the master page
+	data, err := os.ReadFile(IdxFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for pos := tree.BTREE_PAGE_SIZE; pos < len(data); pos += tree.BTREE_PAGE_SIZE {
+		data[pos+100] ^= 0xff
+	}
+	if err := os.WriteFile(IdxFile, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, stmt := range []string{
+		"SELECT * FROM dogs WHERE breed = \"mutt\";",
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");",
+		"CREATE INDEX ON dogs (name);",
+	} {
+		machine := New(compileStatement(t, stmt))
+		err := machine.Run()
+		machine.Close()
+		var perr *tree.PageError
+		if !errors.As(err, &perr) || perr.Msg != "checksum mismatch" {
+			t.Fatalf("%s: expected a checksum mismatch, got %v", stmt, err)
+		}
+	}
+}
+
+// the indexes share a tree, their number is not limited by the catalog
+func TestManyIndexes(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	// the catalog key is longer than a tree name can be
+	long := strings.Repeat("w", 250)
+	tables := []string{long}
+	for i := 0; i < 60; i++ {
+		tables = append(tables, fmt.Sprintf("wishlist%c%c", 'a'+i/26, 'a'+i%26))
+	}
+	for _, tName := range tables {
+		runStatement(t, "CREATE TABLE "+tName+" (name varchar, price varchar);").Close()
+		runStatement(t, "INSERT INTO "+tName+" VALUES (\"4090\", \"1600\");").Close()
+		runStatement(t, "CREATE INDEX ON "+tName+" (name, price);").Close()
+	}
+	// replayed with the rest
+	crash(runStatement(t, "INSERT INTO "+long+" VALUES (\"4090\", \"2000\");"))
+
+	machine := New(&c.Bytecode{})
+	defer machine.Close()
+	if trees := machine.Pool.db.Trees(); !slices.Equal(trees, []string{IndexTree, CatalogTree}) {
+		t.Fatalf("trees: %v", trees)
+	}
+	for _, tName := range tables {
+		checkIndex(t, machine, tName, []string{"name", "price"})
+	}
+	offsets, err := machine.Pool.Lookup(long, []string{"name", "price"}, []string{"4090"})
+	if err != nil || len(offsets) != 2 {
+		t.Fatalf("%d rows (%v)", len(offsets), err)
+	}
+}
+
+// a value too large for an index key fails the INSERT with its row
+func TestInsertIndexKeyTooLarge(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	for _, stmt := range []string{
+		"CREATE TABLE dogs (name varchar, breed varchar);",
+		"INSERT INTO dogs VALUES (\"winnie\", \"lab\");",
+		"CREATE INDEX ON dogs (breed);",
+	} {
+		runStatement(t, stmt).Close()
+	}
+	rows, _ := os.ReadFile(RowsFile)
+	tables, _ := os.ReadFile(TableFile)
+
+	breed := strings.Repeat("b", 1200)
+	machine := New(compileStatement(t, "INSERT INTO dogs VALUES (\"stella\", \""+breed+"\");"))
+	if err := machine.Run(); !errors.Is(err, tree.ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	crash(machine)
+	if after, _ := os.ReadFile(RowsFile); !bytes.Equal(rows, after) {
+		t.Fatalf("the row was written")
+	}
+	if after, _ := os.ReadFile(TableFile); !bytes.Equal(tables, after) {
+		t.Fatalf("the row count was updated")
+	}
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkIndex(t, machine, "dogs", []string{"breed"})
+	if got := selectRows(t, machine, "dogs", [][2]string{{"breed", breed}}); len(got) != 0 {
+		t.Fatalf("found %v", got)
+	}
+}
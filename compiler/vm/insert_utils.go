@@ -9,17 +9,19 @@ import (
 	"github.com/aidanjjenkins/compiler/code"
 )
 
-func (vm *VM) createTableObj(name string) *code.TableInfo {
+func (vm *VM) createTableObj(name string) (*code.TableInfo, error) {
 	tObj := &code.TableInfo{Name: name}
-	offset, ok := vm.Pool.Search(name)
+	offset, ok, err := vm.Pool.Search(name)
+	if err != nil {
+		return nil, err
+	}
 	decoded := []string{}
 	if !ok {
-		fmt.Println("Table not found")
-		return nil
+		return nil, fmt.Errorf("Table not found")
 	} else {
 		row, err := readRow(int64(offset), TableFile)
 		if err != nil {
-			fmt.Println("Error finding table: ", err)
+			return nil, fmt.Errorf("Error finding table: %w", err)
 		}
 
 		decoded = DecodeBytes(row)
@@ -31,7 +33,7 @@ func (vm *VM) createTableObj(name string) *code.TableInfo {
 	tObj.Write = nullArr
 	tObj.ColCounter = 0
 	tObj.ValCounter = 0
-	return tObj
+	return tObj, nil
 }
 
 func getColInfo(cols []string) []*code.ColCell {
@@ -104,7 +106,7 @@ func createNullArrays(size int) [][]byte {
 
 // should look through the table object to see if any of the cols are
 // can eventually do the same for unique and non null
-func (vm *VM) write(table *code.TableInfo) {
+func (vm *VM) write(table *code.TableInfo) error {
 	toWrite := []byte{}
 
 	tName := encodeString(table.Name)
@@ -114,6 +116,7 @@ func (vm *VM) write(table *code.TableInfo) {
 		toWrite = append(toWrite, table.Write[i]...)
 	}
 
+	row := DecodeBytes(toWrite)
 	l := len(toWrite)
 
 	// do i need this big of a row length?
@@ -121,11 +124,16 @@ func (vm *VM) write(table *code.TableInfo) {
 	binary.LittleEndian.PutUint32(lenBuf, uint32(l))
 	toWrite = append(lenBuf, toWrite...)
 
-	writeRowWithoutIndex(toWrite, RowsFile)
+	offset, err := vm.writeRow(toWrite, RowsFile)
+	if err != nil {
+		return err
+	}
 
-	err := vm.incrememntRowCount(table.Name)
+	err = vm.incrememntRowCount(table.Name)
 	if err != nil {
-		fmt.Println("error: ", err)
-		return
+		return err
 	}
+
+	// the indexes are updated in the same statement as the row
+	return vm.indexRow(table.Name, table.Cols, row, offset)
 }
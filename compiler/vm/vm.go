@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"slices"
+	"strings"
 
 	tree "github.com/aidanjjenkins/bplustree"
 	"github.com/aidanjjenkins/compiler/code"
@@ -31,18 +32,41 @@ type Pool struct {
 	db tree.Pager
 }
 
-func newPool() *Pool {
+func OpenPool(path string, readOnly bool) (*Pool, error) {
 	p := &Pool{}
-	p.db.Path = IdxFile
+	p.db.Path = path
+	p.db.ReadOnly = readOnly
 	err := p.db.Open()
 	if err != nil {
-		fmt.Println("err: ", err)
+		return nil, err
 	}
-	return p
+	return p, nil
+}
+
+func (p *Pool) Close() {
+	p.db.Close()
+}
+
+// check the index file for corruption
+func (p *Pool) Verify() []error {
+	return p.db.Verify()
+}
+
+// the shape of the index trees and the page usage
+func (p *Pool) Stats() (tree.Stats, error) {
+	return p.db.Stats()
+}
+
+// print the nodes of the index trees
+func (p *Pool) Dump(w io.Writer) error {
+	return p.db.Dump(w)
 }
 
 type VM struct {
 	Pool         *Pool
+	wal          *WAL
+	err          error // the files could not be opened
+	readOnly     bool
 	Instructions code.Instructions
 	constants    []code.Obj
 	Stack        []code.Obj
@@ -50,32 +74,170 @@ type VM struct {
 }
 
 func New(bytecode *c.Bytecode) *VM {
+	return newVM(bytecode, false)
+}
+
+// statements that write fail, the files are neither created nor modified
+func NewReadOnly(bytecode *c.Bytecode) *VM {
+	return newVM(bytecode, true)
+}
+
+func newVM(bytecode *c.Bytecode, readOnly bool) *VM {
 	vm := VM{
-		Pool:         newPool(),
 		Instructions: bytecode.Instructions,
 		constants:    bytecode.Constants,
 		Stack:        make([]code.Obj, StackSize),
 		sp:           0,
+		readOnly:     readOnly,
+	}
+
+	// the files stay locked until Close()
+	pool, err := OpenPool(IdxFile, readOnly)
+	if err != nil {
+		vm.err = err
+		return &vm
+	}
+	vm.Pool = pool
+
+	// the shared lock on the index keeps writers out,
+	// so the log can only be left over by a crash.
+	if readOnly {
+		if err := checkWAL(WalFile); err != nil {
+			vm.err = err
+		} else if legacy, err := pool.legacyKeys(); err != nil {
+			vm.err = err
+		} else if len(legacy) > 0 {
+			vm.err = ErrUpgradeNeeded
+		}
+		return &vm
+	}
+
+	// recover the statements of a crashed run
+	wal, err := openWAL(WalFile, vm.Pool)
+	if err != nil {
+		vm.err = err
+		return &vm
 	}
+	vm.wal = wal
 
+	if err := vm.upgradeIndex(); err != nil {
+		vm.err = err
+	}
 	return &vm
 }
 
-func (p *Pool) Add(key string, val uint32) {
-	k := []byte(key)
+// the error of the log, the files are closed anyway
+func (vm *VM) Close() error {
+	var err error
+	if vm.wal != nil {
+		err = vm.wal.Close()
+	}
+	if vm.Pool != nil {
+		vm.Pool.Close()
+	}
+	return err
+}
+
+// checked before a statement writes anything
+func (vm *VM) writable() error {
+	if vm.readOnly {
+		return tree.ErrReadOnly
+	}
+	return nil
+}
+
+// each statement is applied as a whole or not at all
+func (vm *VM) commit() error {
+	if vm.wal == nil {
+		return fmt.Errorf("WAL is not open")
+	}
+	return vm.wal.commit(vm.Pool)
+}
+
+// drop the changes of a statement that failed before its commit
+func (vm *VM) abort(err error) error {
+	if vm.wal != nil {
+		vm.wal.abort()
+	}
+	return err
+}
+
+// added to the catalog when the statement commits
+func (vm *VM) addTable(tName string, offset uint32) {
 	offsetBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(offsetBytes, val)
-	p.db.Set(k, offsetBytes)
+	binary.LittleEndian.PutUint32(offsetBytes, offset)
+	vm.wal.setIndex(CatalogTree, []byte(tName), offsetBytes)
 }
 
-func (p *Pool) Search(key string) (uint32, bool) {
-	bytes, found := p.db.Get(key)
+// an index of the table in the catalog, returns its new id.
+// the ids are after the ones in the catalog and in the statement.
+func (vm *VM) addIndexDef(tName string, cols []string) (uint32, error) {
+	def := indexDef(tName, cols)
+	// a second id would leave the keys of the first one behind
+	existing, err := vm.Pool.indexID(tName, cols)
+	if err != nil {
+		return 0, err
+	}
+	id, err := vm.Pool.maxIndexID()
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range vm.wal.batch {
+		if rec.tree == CatalogTree && strings.HasPrefix(string(rec.key), "index:") && len(rec.data) == 4 {
+			id = max(id, binary.LittleEndian.Uint32(rec.data))
+			if string(rec.key) == def {
+				existing = 1
+			}
+		}
+	}
+	if existing != 0 {
+		return 0, fmt.Errorf("Index already exists: %s (%s)", tName, strings.Join(cols, ", "))
+	}
+	id++
+
+	idBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(idBytes, id)
+	vm.wal.setIndex(CatalogTree, []byte(def), idBytes)
+	return id, nil
+}
+
+// added to the index when the statement commits.
+// values too large for a key fail the statement.
+func (vm *VM) addIndexKey(id uint32, vals []string, offset uint32) error {
+	key := indexKey(id, vals, offset)
+	if err := tree.CheckKey(key); err != nil {
+		return err
+	}
+	offsetBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(offsetBytes, offset)
+	vm.wal.setIndex(IndexTree, key, offsetBytes)
+	return nil
+}
+
+// like addIndexKey, but the keys of the statement are bulk loaded
+func (vm *VM) loadIndex(id uint32, vals []string, offset uint32) error {
+	key := indexKey(id, vals, offset)
+	if err := tree.CheckKey(key); err != nil {
+		return err
+	}
+	offsetBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(offsetBytes, offset)
+	vm.wal.loadIndex(IndexTree, key, offsetBytes)
+	return nil
+}
+
+// look up a table in the catalog, returns its offset in tables.db
+func (p *Pool) Search(tName string) (uint32, bool, error) {
+	bytes, found, err := p.db.Tree(CatalogTree).Get([]byte(tName))
+	if err != nil {
+		return 0, false, err
+	}
 	if found {
 		value := binary.LittleEndian.Uint32(bytes)
-		return value, true
+		return value, true, nil
 	} else {
 		fmt.Println(">>> Value not found")
-		return 0, false
+		return 0, false, nil
 	}
 }
 
@@ -109,6 +271,9 @@ func (vm *VM) pop() code.Obj {
 }
 
 func (vm *VM) Run() error {
+	if vm.err != nil {
+		return vm.err
+	}
 	for ip := 0; ip < len(vm.Instructions); ip++ {
 		op := code.Opcode(vm.Instructions[ip])
 		switch op {
@@ -135,8 +300,16 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpCreateTable:
+			if err := vm.writable(); err != nil {
+				return err
+			}
 			numVals := code.ReadUint8(vm.Instructions[ip+1:])
-			vm.executeTableWrite(int(numVals))
+			if err := vm.executeTableWrite(int(numVals)); err != nil {
+				return vm.abort(err)
+			}
+			if err := vm.commit(); err != nil {
+				return err
+			}
 		case code.OpTableNameSearch:
 			opRead := code.ReadUint16(vm.Instructions[ip+1:])
 			table := vm.constants[opRead]
@@ -158,15 +331,25 @@ func (vm *VM) Run() error {
 				}
 			}
 		case code.OpCreateTableIndex:
+			if err := vm.writable(); err != nil {
+				return err
+			}
 			opRead := code.ReadUint16(vm.Instructions[ip+1:])
 			table := vm.constants[opRead]
 			switch table := table.(type) {
 			case *code.TableName:
-				vm.executeAddIndex(table.Value)
+				if err := vm.executeAddIndex(table.Value); err != nil {
+					return vm.abort(err)
+				}
+			}
+			if err := vm.commit(); err != nil {
+				return err
 			}
 		case code.OpSelect:
 			numVals := code.ReadUint8(vm.Instructions[ip+1:])
-			vm.executeRowSearch(int(numVals))
+			if err := vm.executeRowSearch(int(numVals)); err != nil {
+				return err
+			}
 			for vm.sp > 0 {
 				val := vm.pop()
 				if v, ok := val.(*code.FoundRow); ok {
@@ -187,15 +370,26 @@ func (vm *VM) Run() error {
 			//[7, stella, 0xFE, 0xFE]
 			//[7, stella, 0xFE ,20]
 		case code.OpInsertRow:
+			if err := vm.writable(); err != nil {
+				return err
+			}
 			numVals := code.ReadUint8(vm.Instructions[ip+1:])
-			vm.executeRowWrite(int(numVals))
+			if err := vm.executeRowWrite(int(numVals)); err != nil {
+				return vm.abort(err)
+			}
+			if err := vm.commit(); err != nil {
+				return err
+			}
 		case code.OpTableInfo:
 			opRead := code.ReadUint16(vm.Instructions[ip+1:])
 			table := vm.constants[opRead]
 			switch table := table.(type) {
 			case *code.TableName:
-				tObj := vm.createTableObj(table.Value)
-				err := vm.push(tObj)
+				tObj, err := vm.createTableObj(table.Value)
+				if err != nil {
+					return err
+				}
+				err = vm.push(tObj)
 				if err != nil {
 					return err
 				}
@@ -229,9 +423,17 @@ func (vm *VM) Run() error {
 				}
 			}
 		case code.OpInsert:
+			if err := vm.writable(); err != nil {
+				return err
+			}
 			tableObj := vm.pop()
 			if t, ok := tableObj.(*code.TableInfo); ok {
-				vm.write(t)
+				if err := vm.write(t); err != nil {
+					return vm.abort(err)
+				}
+			}
+			if err := vm.commit(); err != nil {
+				return err
 			}
 		case code.OpUpdate:
 		}
@@ -240,37 +442,31 @@ func (vm *VM) Run() error {
 	return nil
 }
 
-func (vm *VM) FindTable(name string) []byte {
-	offset, ok := vm.Pool.Search(name)
+func (vm *VM) FindTable(name string) ([]byte, error) {
+	offset, ok, err := vm.Pool.Search(name)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		fmt.Println("key not found")
-		return nil
+		return nil, fmt.Errorf("Table not found")
 	} else {
 		row, err := readRow(int64(offset), TableFile)
 		if err != nil {
-			fmt.Println("Error finding table: ", err)
+			return nil, fmt.Errorf("Error finding table: %w", err)
 		}
 
-		return row
+		return row, nil
 	}
 }
 
-func writeRow(data []byte, filename string) (uint32, error) {
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return 0, err
-	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	fileLen := fileInfo.Size()
-
-	_, err = file.Write(data)
+// appended when the statement commits
+func (vm *VM) writeRow(data []byte, filename string) (uint32, error) {
+	offset, err := vm.wal.append(filename, data)
 	if err != nil {
 		return 0, err
 	}
 
-	return uint32(fileLen), nil
+	return uint32(offset), nil
 }
 
 func readRow(offset int64, filename string) ([]byte, error) {
@@ -288,6 +484,13 @@ func readRow(offset int64, filename string) ([]byte, error) {
 
 	length := binary.LittleEndian.Uint64(lengthBytes)
 	// Calculate the end offset
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(fi.Size()-offset-8) {
+		return nil, fmt.Errorf("row at %d is out of %s", offset, filename)
+	}
 
 	bytes := make([]byte, length)
 	_, err = file.ReadAt(bytes, offset+8)
@@ -381,23 +584,26 @@ func (vm *VM) executeTableWrite(numVals int) error {
 	binary.LittleEndian.PutUint32(lenBuf, uint32(l))
 	write = append(lenBuf, write...)
 
-	offset, err := writeRow(write, TableFile)
+	offset, err := vm.writeRow(write, TableFile)
 	if err != nil {
 		return fmt.Errorf("Error writing table to disk")
 	}
 
-	vm.Pool.Add(tName, offset)
+	vm.addTable(tName, offset)
 	return nil
 }
 
 func (vm *VM) incrememntRowCount(tName string) error {
-	offset, ok := vm.Pool.Search(tName)
+	offset, ok, err := vm.Pool.Search(tName)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return fmt.Errorf("Table not found")
 	} else {
 		row, err := readRow(int64(offset), TableFile)
 		if err != nil {
-			fmt.Println("Error finding table: ", err)
+			return fmt.Errorf("Error finding table: %w", err)
 		}
 
 		count := DecodeTableCount(row)
@@ -409,17 +615,7 @@ func (vm *VM) incrememntRowCount(tName string) error {
 		row = row[:len(row)-RowLen]
 		row = append(row, updateCount...)
 
-		file, err := os.OpenFile(TableFile, os.O_RDWR, 0644)
-		if err != nil {
-			fmt.Printf("Failed to open file: %v", err)
-		}
-		defer file.Close()
-
-		_, err = file.WriteAt(row, int64(offset)+RowLen)
-		if err != nil {
-			fmt.Printf("Failed to open file: %v", err)
-		}
-
+		vm.wal.writeAt(TableFile, int64(offset)+RowLen, row)
 	}
 
 	return nil
@@ -434,7 +630,7 @@ func getTableName(data []byte) string {
 	return string(data)
 }
 
-func (vm *VM) executeRowWrite(numVals int) {
+func (vm *VM) executeRowWrite(numVals int) error {
 	write := []byte{}
 	for numVals > 0 {
 		val := vm.pop()
@@ -448,34 +644,28 @@ func (vm *VM) executeRowWrite(numVals int) {
 	tName := getTableName(write)
 	err := vm.incrememntRowCount(tName)
 	if err != nil {
-		fmt.Println("error: ", err)
-		return
+		return err
 	}
 
+	row := DecodeBytes(write)
 	l := len(write)
 	// do i need this big of a row length?
 	lenBuf := make([]byte, RowLen)
 	binary.LittleEndian.PutUint32(lenBuf, uint32(l))
 	write = append(lenBuf, write...)
-	writeRowWithoutIndex(write, RowsFile)
-}
-
-func writeRowWithoutIndex(data []byte, filename string) error {
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	offset, err := vm.writeRow(write, RowsFile)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.Write(data)
+	table, err := vm.FindTable(tName)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return vm.indexRow(tName, getColInfo(DecodeBytes(table)[1:]), row, offset)
 }
 
-func (vm *VM) executeRowSearch(numVals int) {
+func (vm *VM) executeRowSearch(numVals int) error {
 	table := ""
 	cols2Find := []string{}
 	vals2Find := []string{}
@@ -492,7 +682,10 @@ func (vm *VM) executeRowSearch(numVals int) {
 		numVals -= 1
 	}
 
-	tableBytes := vm.FindTable(table)
+	tableBytes, err := vm.FindTable(table)
+	if err != nil {
+		return err
+	}
 	decoded := DecodeBytes(tableBytes)
 	tName := decoded[0]
 	decoded = decoded[1:]
@@ -506,7 +699,16 @@ func (vm *VM) executeRowSearch(numVals int) {
 
 	idxs := getColIdxFromTable(tablesCols, cols2Find)
 
-	vm.walkTable(RowsFile, tName, idxs, vals2Find)
+	// the full scan is only needed without an index on the WHERE columns
+	index, n, err := vm.chooseIndex(tName, getColInfo(decoded), cols2Find)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		vm.walkTable(RowsFile, tName, idxs, vals2Find)
+		return nil
+	}
+	return vm.indexSearch(tName, index, n, idxs, cols2Find, vals2Find)
 }
 
 func getColIdxFromTable(table, cols []string) []int {
@@ -582,36 +784,51 @@ func searchRow(idxs []int, row, vals []string) bool {
 	return true
 }
 
-func (vm *VM) executeAddIndex(tName string) {
-	table := vm.FindTable(tName)
+func (vm *VM) executeAddIndex(tName string) error {
+	table, err := vm.FindTable(tName)
+	if err != nil {
+		return err
+	}
 	count := DecodeTableCount(table)
 	cols := []string{}
 	for vm.sp > 0 {
 		val := vm.pop()
 		switch v := val.(type) {
 		case *code.Col:
-			cols = append(cols, v.Value)
+			// in the order of the statement, the first column sorts first
+			cols = append([]string{v.Value}, cols...)
 		}
 	}
 
-	vm.markAsIndex(tName, cols)
 	decodedTable := DecodeBytes(table)
-	coldIdxs := getColIdxFromTable(decodedTable, cols)
+	colIdxs := getColPositions(getColInfo(decodedTable[1:]), cols)
+	for i := range colIdxs {
+		if colIdxs[i] < 0 {
+			return fmt.Errorf("Column not found: %s", cols[i])
+		}
+	}
 
+	// one index on all the columns
+	id, err := vm.addIndexDef(tName, cols)
+	if err != nil {
+		return err
+	}
+	if err := vm.markAsIndex(tName, cols); err != nil {
+		return err
+	}
 	if count > 0 {
-		vm.addExistingRowsToIndex(tName, coldIdxs, count)
+		return vm.addExistingRowsToIndex(tName, id, colIdxs, count)
 	}
+	return nil
 }
 
-// using the get coldidxfrom table to find out which item to insert,
-// at every row, add length to the "offset" var to keep track of offset,
-// if table name is correct, access idx from coldixfrom table that matchs, insert using offset and col val
-func (vm *VM) addExistingRowsToIndex(tName string, colIdx []int, count int) error {
+// at every row, keep track of its offset, if the table name is correct,
+// add the values at the positions in colIdx to the index with the id
+func (vm *VM) addExistingRowsToIndex(tName string, id uint32, colIdx []int, count int) error {
 	// offset := 0
 	file, err := os.Open(RowsFile)
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
-		return nil
+		return fmt.Errorf("Error opening file: %w", err)
 	}
 	defer file.Close()
 
@@ -619,13 +836,11 @@ func (vm *VM) addExistingRowsToIndex(tName string, colIdx []int, count int) erro
 	for {
 
 		if rowsChecked >= count {
-			fmt.Println("checked all rows in table")
 			break
 		}
 		offset, err := file.Seek(0, io.SeekCurrent)
 		if err != nil {
-			fmt.Printf("Error getting offset: %v\n", err)
-			return nil
+			return fmt.Errorf("Error getting offset: %w", err)
 		}
 
 		lengthBytes := make([]byte, 8)
@@ -634,8 +849,7 @@ func (vm *VM) addExistingRowsToIndex(tName string, colIdx []int, count int) erro
 			if err.Error() == "EOF" {
 				break
 			}
-			fmt.Printf("Error reading length: %v\n", err)
-			return nil
+			return fmt.Errorf("Error reading length: %w", err)
 		}
 
 		rowLength := binary.LittleEndian.Uint32(lengthBytes)
@@ -643,8 +857,7 @@ func (vm *VM) addExistingRowsToIndex(tName string, colIdx []int, count int) erro
 		rowData := make([]byte, rowLength)
 		_, err = file.Read(rowData)
 		if err != nil {
-			fmt.Printf("Error reading row: %v\n", err)
-			return nil
+			return fmt.Errorf("Error reading row: %w", err)
 		}
 
 		decoded := DecodeBytes(rowData)
@@ -653,29 +866,32 @@ func (vm *VM) addExistingRowsToIndex(tName string, colIdx []int, count int) erro
 		}
 
 		if decoded[0] == tName {
+			vals := []string{}
 			for i := range colIdx {
-				// fmt.Println("col val: ", decoded[colIdx[i]])
-				// fmt.Println("offset: ", offset)
-
-				vm.Pool.Add(decoded[colIdx[i]], uint32(offset))
+				vals = append(vals, decoded[colIdx[i]])
 			}
-
+			if err := vm.loadIndex(id, vals, uint32(offset)); err != nil {
+				return err
+			}
+			rowsChecked++
 		}
 	}
 
 	return nil
 }
 
-func (vm *VM) markAsIndex(tName string, cols []string) {
-	offset, ok := vm.Pool.Search(tName)
+func (vm *VM) markAsIndex(tName string, cols []string) error {
+	offset, ok, err := vm.Pool.Search(tName)
+	if err != nil {
+		return err
+	}
 	decoded := []string{}
 	if !ok {
-		fmt.Println("Table not found")
-		return
+		return fmt.Errorf("Table not found")
 	} else {
 		row, err := readRow(int64(offset), TableFile)
 		if err != nil {
-			fmt.Println("Error finding table: ", err)
+			return fmt.Errorf("Error finding table: %w", err)
 		}
 
 		decoded = DecodeBytes(row)
@@ -700,14 +916,6 @@ func (vm *VM) markAsIndex(tName string, cols []string) {
 		}
 	}
 
-	file, err := os.OpenFile(TableFile, os.O_RDWR, 0644)
-	if err != nil {
-		fmt.Println("Error opening table file: ", err)
-	}
-	defer file.Close()
-
-	_, err = file.WriteAt(buf, int64(offset)+int64(RowLen))
-	if err != nil {
-		fmt.Println("Error writing table file: ", err)
-	}
+	vm.wal.writeAt(TableFile, int64(offset)+int64(RowLen), buf)
+	return nil
 }
@@ -63,6 +63,7 @@ func TestAddTable(t *testing.T) {
 
 	os.Remove(IdxFile)
 	os.Remove(TableFile)
+	os.Remove(WalFile)
 }
 
 func testAddTableStatement(t *testing.T, stmt ast.Statement, comp *c.Compiler, vals []string) bool {
@@ -73,13 +74,14 @@ func testAddTableStatement(t *testing.T, stmt ast.Statement, comp *c.Compiler, v
 	}
 
 	machine := New(comp.Bytecode())
+	defer machine.Close()
 	err = machine.Run()
 	if err != nil {
 		t.Error("Error running")
 		return false
 	}
 
-	offset, ok := machine.Pool.Search("dogs")
+	offset, ok, _ := machine.Pool.Search("dogs")
 	decoded := []string{}
 	var count int
 	if !ok {
@@ -130,6 +132,7 @@ func TestInsert(t *testing.T) {
 			os.Remove(IdxFile)
 			os.Remove(RowsFile)
 			os.Remove(TableFile)
+			os.Remove(WalFile)
 			return
 		}
 
@@ -138,6 +141,7 @@ func TestInsert(t *testing.T) {
 	os.Remove(IdxFile)
 	os.Remove(RowsFile)
 	os.Remove(TableFile)
+	os.Remove(WalFile)
 }
 
 func testInsert(t *testing.T, stmt ast.Statement, comp *c.Compiler, expected []string, count int) bool {
@@ -148,6 +152,7 @@ func testInsert(t *testing.T, stmt ast.Statement, comp *c.Compiler, expected []s
 	}
 
 	machine := New(comp.Bytecode())
+	defer machine.Close()
 	err = machine.Run()
 	if err != nil {
 		t.Error("Error running")
@@ -167,7 +172,7 @@ func testInsert(t *testing.T, stmt ast.Statement, comp *c.Compiler, expected []s
 		}
 	}
 
-	offset, ok := machine.Pool.Search(expected[0])
+	offset, ok, _ := machine.Pool.Search(expected[0])
 	var c int
 	if !ok {
 		fmt.Println("Table not found")
@@ -211,6 +216,7 @@ func TestInsertDouble(t *testing.T) {
 			os.Remove(IdxFile)
 			os.Remove(RowsFile)
 			os.Remove(TableFile)
+			os.Remove(WalFile)
 			return
 		}
 
@@ -219,6 +225,7 @@ func TestInsertDouble(t *testing.T) {
 	os.Remove(IdxFile)
 	os.Remove(RowsFile)
 	os.Remove(TableFile)
+	os.Remove(WalFile)
 }
 
 func testInsertDouble(t *testing.T, stmt ast.Statement, comp *c.Compiler, expected []string, count int) bool {
@@ -229,6 +236,7 @@ func testInsertDouble(t *testing.T, stmt ast.Statement, comp *c.Compiler, expect
 	}
 
 	machine := New(comp.Bytecode())
+	defer machine.Close()
 	err = machine.Run()
 	if err != nil {
 		t.Error("Error running")
@@ -248,7 +256,7 @@ func testInsertDouble(t *testing.T, stmt ast.Statement, comp *c.Compiler, expect
 		}
 	}
 
-	offset, ok := machine.Pool.Search(expected[0])
+	offset, ok, _ := machine.Pool.Search(expected[0])
 	var c int
 	if !ok {
 		fmt.Println("Table not found")
@@ -362,6 +370,7 @@ func createDummyTables(t *testing.T) {
 
 		machine := New(comp.Bytecode())
 		err = machine.Run()
+		machine.Close()
 		if err != nil {
 			t.Error("Error running")
 		}
@@ -397,6 +406,7 @@ func createDummyTablesForInsert(t *testing.T) {
 
 		machine := New(comp.Bytecode())
 		err = machine.Run()
+		machine.Close()
 		if err != nil {
 			t.Error("Error running")
 		}
@@ -429,6 +439,7 @@ func TestSelect(t *testing.T) {
 	os.Remove(IdxFile)
 	os.Remove(TableFile)
 	os.Remove(RowsFile)
+	os.Remove(WalFile)
 }
 
 func testSelect(t *testing.T, stmt ast.Statement, comp *c.Compiler) bool {
@@ -439,6 +450,7 @@ func testSelect(t *testing.T, stmt ast.Statement, comp *c.Compiler) bool {
 	}
 
 	machine := New(comp.Bytecode())
+	defer machine.Close()
 	err = machine.Run()
 	if err != nil {
 		t.Error("Error running")
@@ -468,10 +480,13 @@ func TestAddIndex(t *testing.T) {
 		tName    string
 		idx      []int
 		expected []string
+		col      string
 		newIdxs  []string
+		counts   []int // rows with each value
 	}{
 		// {"CREATE INDEX ON wishlist (name, price);", "wishlist", []int{3, 13}, []string{"true", "true"}},
-		{"CREATE INDEX ON coffee (region);", "coffee", []int{3}, []string{"true"}, []string{"colombia", "ethiopia", "kenya"}},
+		{"CREATE INDEX ON coffee (region);", "coffee", []int{3}, []string{"true"}, "region", []string{"colombia", "ethiopia", "kenya"}, []int{1, 1, 1}},
+		{"CREATE INDEX ON coffee (brand);", "coffee", []int{8}, []string{"true"}, "brand", []string{"onyx", "prodigal", "counter culture"}, []int{1, 2, 0}},
 	}
 
 	for _, tt := range tests {
@@ -483,7 +498,7 @@ func TestAddIndex(t *testing.T) {
 		stmt := program.Statements[0]
 		comp := c.New()
 
-		if !testAddIndex(t, stmt, comp, tt.tName, tt.idx, tt.expected, tt.newIdxs) {
+		if !testAddIndex(t, stmt, comp, tt.tName, tt.idx, tt.expected, tt.col, tt.newIdxs, tt.counts) {
 			return
 		}
 
@@ -492,9 +507,10 @@ func TestAddIndex(t *testing.T) {
 	os.Remove(IdxFile)
 	os.Remove(RowsFile)
 	os.Remove(TableFile)
+	os.Remove(WalFile)
 }
 
-func testAddIndex(t *testing.T, stmt ast.Statement, comp *c.Compiler, tName string, idxs []int, expected []string, check []string) bool {
+func testAddIndex(t *testing.T, stmt ast.Statement, comp *c.Compiler, tName string, idxs []int, expected []string, col string, check []string, counts []int) bool {
 	err := comp.Compile(stmt)
 	if err != nil {
 		t.Error("Compile error: ", err)
@@ -502,13 +518,14 @@ func testAddIndex(t *testing.T, stmt ast.Statement, comp *c.Compiler, tName stri
 	}
 
 	machine := New(comp.Bytecode())
+	defer machine.Close()
 	err = machine.Run()
 	if err != nil {
 		t.Error("Error running")
 		return false
 	}
 
-	offset, ok := machine.Pool.Search(tName)
+	offset, ok, _ := machine.Pool.Search(tName)
 	decoded := []string{}
 	if !ok {
 		fmt.Println("Table not found")
@@ -529,23 +546,30 @@ func testAddIndex(t *testing.T, stmt ast.Statement, comp *c.Compiler, tName stri
 		}
 	}
 
+	// the values are only in the index of the column
+	if _, ok, _ := machine.Pool.db.Tree(CatalogTree).Get([]byte(check[0])); ok {
+		t.Errorf("%s is in the catalog", check[0])
+		return false
+	}
 	for i := range check {
-		newOffset, ok := machine.Pool.Search(check[i])
-		dRow := []string{}
-		if !ok {
-			fmt.Println("Table not found")
-		} else {
+		offsets, err := machine.Pool.Lookup(tName, []string{col}, []string{check[i]})
+		if err != nil || len(offsets) != counts[i] {
+			t.Errorf("%s: expected %d rows, got %d", check[i], counts[i], len(offsets))
+			return false
+		}
+		for _, newOffset := range offsets {
 			row, err := readRow(int64(newOffset), RowsFile)
 			if err != nil {
-				fmt.Println("Error finding table: ", err)
+				t.Errorf("Error finding row: %v", err)
+				return false
 			}
+			dRow := DecodeBytes(row)
 
-			dRow = DecodeBytes(row)
-		}
-
-		if dRow[1] != check[i] {
-			t.Errorf("expected: %s, got: %s", check[i], dRow[1])
-			return false
+			// the flag of column i is at 3 + 5*i, its value at 1 + i in the row
+			if dRow[idxs[0]/5+1] != check[i] {
+				t.Errorf("expected: %s, got: %s", check[i], dRow[idxs[0]/5+1])
+				return false
+			}
 		}
 	}
 
@@ -0,0 +1,508 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	tree "github.com/aidanjjenkins/bplustree"
+)
+
+// ------------------------------------------------
+// WAL record layout
+//  len       checksum   type     payload
+// | 4 bytes | 4 bytes  | 1 byte | len bytes |
+// ------------------------------------------------
+// payload of each type
+//  write:  file id (1 byte) | offset (8 bytes) | data
+//  index:  key length (4 bytes) | key | value
+//  load:   same as index
+//  commit: empty
+//  tree index: name length (1 byte) | tree name | then as index
+//  tree load:  same as tree index
+// ------------------------------------------------
+// index and load records of the default tree are only written by older
+// versions, they are still replayed.
+// every change to the data files is logged before it's applied.
+// the changes of a statement are followed by a commit record,
+// only committed statements are replayed on startup.
+// a statement is checked before it's logged, see walCheck(), so the
+// statements in the log can always be applied.
+
+const WalFile string = "wal.db"
+
+// the data files are synced and the log is emptied past this size
+const WalCheckpointSize = 1 << 20
+
+const walHeader = 4 + 4 + 1
+
+var ErrRecoveryNeeded = errors.New("the WAL has statements to recover, open the database for writing first")
+
+const (
+	walWrite  = 1 // write data at an offset of a data file
+	walIndex  = 2 // insert or update an index key
+	walCommit = 3 // the end of a statement
+	walLoad   = 4 // an index key of a bulk load, see walApply()
+	// the same in a named tree, see index.go
+	walTreeIndex = 5
+	walTreeLoad  = 6
+)
+
+// data files that are written through the log, by id
+var walFiles = []string{TableFile, RowsFile}
+
+type walRecord struct {
+	typ    byte
+	file   byte
+	offset int64
+	tree   string // "" for the default tree
+	key    []byte
+	data   []byte
+}
+
+type WAL struct {
+	fp      *os.File
+	size    int64
+	batch   []walRecord      // changes of the current statement
+	pending map[string]int64 // bytes appended to each file by the batch
+	failed  error            // a logged statement is half applied, see commit()
+}
+
+func walFileID(filename string) byte {
+	for i, name := range walFiles {
+		if name == filename {
+			return byte(i)
+		}
+	}
+	panic("not a data file: " + filename)
+}
+
+func walEncode(buf []byte, rec walRecord) []byte {
+	payload := []byte{}
+	switch rec.typ {
+	case walWrite:
+		payload = append(payload, rec.file)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(rec.offset))
+		payload = append(payload, rec.data...)
+	case walTreeIndex, walTreeLoad:
+		// at most tree.MAX_TREE_NAME bytes, see walCheck()
+		payload = append(payload, byte(len(rec.tree)))
+		payload = append(payload, rec.tree...)
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(rec.key)))
+		payload = append(payload, rec.key...)
+		payload = append(payload, rec.data...)
+	case walIndex, walLoad:
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(rec.key)))
+		payload = append(payload, rec.key...)
+		payload = append(payload, rec.data...)
+	}
+
+	head := make([]byte, walHeader)
+	binary.LittleEndian.PutUint32(head[0:], uint32(len(payload)))
+	head[8] = rec.typ
+	sum := crc32.ChecksumIEEE(head[8:])
+	sum = crc32.Update(sum, crc32.IEEETable, payload)
+	binary.LittleEndian.PutUint32(head[4:], sum)
+
+	buf = append(buf, head...)
+	return append(buf, payload...)
+}
+
+// parse 1 record, returns the bytes used or 0 for a bad or incomplete record.
+func walDecode(data []byte) (walRecord, int) {
+	rec := walRecord{}
+	if len(data) < walHeader {
+		return rec, 0
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if size > len(data)-walHeader {
+		return rec, 0
+	}
+	end := walHeader + size
+	if crc32.ChecksumIEEE(data[8:end]) != binary.LittleEndian.Uint32(data[4:]) {
+		return rec, 0
+	}
+
+	rec.typ = data[8]
+	payload := data[walHeader:end]
+	switch rec.typ {
+	case walWrite:
+		if len(payload) < 9 || int(payload[0]) >= len(walFiles) {
+			return rec, 0
+		}
+		rec.file = payload[0]
+		rec.offset = int64(binary.LittleEndian.Uint64(payload[1:]))
+		rec.data = payload[9:]
+	case walTreeIndex, walTreeLoad:
+		if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+			return rec, 0
+		}
+		rec.tree = string(payload[1 : 1+payload[0]])
+		payload = payload[1+len(rec.tree):]
+		fallthrough
+	case walIndex, walLoad:
+		if len(payload) < 4 {
+			return rec, 0
+		}
+		klen := int(binary.LittleEndian.Uint32(payload))
+		if klen > len(payload)-4 {
+			return rec, 0
+		}
+		rec.key = payload[4 : 4+klen]
+		rec.data = payload[4+klen:]
+	case walCommit:
+	default:
+		return rec, 0
+	}
+	return rec, end
+}
+
+// open the log and replay the committed statements in it
+func openWAL(path string, pool *Pool) (*WAL, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open WAL: %w", err)
+	}
+	// all writes to the data files go through the log,
+	// so the lock on it covers them.
+	if err := tree.LockFile(fp, false); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%w: %s", err, path)
+	}
+	w := &WAL{fp: fp, pending: map[string]int64{}}
+
+	data, err := io.ReadAll(fp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("read WAL: %w", err)
+	}
+	if err := walReplay(data, pool); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	// the torn tail of a crashed statement is dropped here
+	if err := w.checkpoint(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// the log is not replayed in read-only mode,
+// the files are only consistent if there is nothing to replay.
+func checkWAL(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read WAL: %w", err)
+	}
+	for pos := 0; pos < len(data); {
+		rec, n := walDecode(data[pos:])
+		if n == 0 {
+			break
+		}
+		if rec.typ == walCommit {
+			return ErrRecoveryNeeded
+		}
+		pos += n
+	}
+	return nil
+}
+
+func walReplay(data []byte, pool *Pool) error {
+	batch := []walRecord{}
+	for pos := 0; pos < len(data); {
+		rec, n := walDecode(data[pos:])
+		if n == 0 {
+			break // the rest was not committed
+		}
+		pos += n
+		if rec.typ != walCommit {
+			batch = append(batch, rec)
+			continue
+		}
+		// logged by an older version that didn't check the statements,
+		// it can never be applied. the log is kept for a manual recovery.
+		if err := walCheck(batch, pool); err != nil {
+			return fmt.Errorf("replay WAL: %w", err)
+		}
+		// writes are idempotent, so statements applied before the crash
+		// are simply applied again
+		if err := walApply(batch, pool); err != nil {
+			return fmt.Errorf("replay WAL: %w", err)
+		}
+		batch = batch[:0]
+	}
+	return nil
+}
+
+// the errors that would fail walApply() every time: bad keys, bad tree
+// names and new trees that don't fit in the catalog.
+func walCheck(batch []walRecord, pool *Pool) error {
+	names := []string{}
+	for _, rec := range batch {
+		switch rec.typ {
+		case walIndex, walLoad, walTreeIndex, walTreeLoad:
+			if err := tree.CheckKey(rec.key); err != nil {
+				return err
+			}
+		}
+		if rec.tree != "" {
+			names = append(names, rec.tree)
+		}
+	}
+	return pool.db.CheckTrees(names...)
+}
+
+// apply the changes of a committed statement, the index first.
+// the data files are not written if the index update fails.
+func walApply(batch []walRecord, pool *Pool) error {
+	if err := walApplyIndex(batch, pool); err != nil {
+		return err
+	}
+	return walApplyFiles(batch)
+}
+
+// the index updates of a statement in a transaction.
+// the keys of a bulk load are sorted and merged into each tree at once,
+// after the other index updates of the statement.
+func walApplyIndex(batch []walRecord, pool *Pool) error {
+	loads := map[string][]walRecord{}
+	tx := pool.db.Begin()
+	for _, rec := range batch {
+		switch rec.typ {
+		case walIndex:
+			if err := tx.Set(rec.key, rec.data); err != nil {
+				tx.Abort()
+				return err
+			}
+		case walTreeIndex:
+			if err := tx.Tree(rec.tree).Set(rec.key, rec.data); err != nil {
+				tx.Abort()
+				return err
+			}
+		case walLoad, walTreeLoad:
+			loads[rec.tree] = append(loads[rec.tree], rec)
+		}
+	}
+	names := make([]string, 0, len(loads))
+	for name := range loads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		if name == "" {
+			err = tx.Load(walLoadKeys(loads[name]))
+		} else {
+			err = tx.Tree(name).Load(walLoadKeys(loads[name]))
+		}
+		if err != nil {
+			return err // aborted
+		}
+	}
+	return tx.Commit()
+}
+
+func walApplyFiles(batch []walRecord) error {
+	files := map[byte]*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, rec := range batch {
+		if rec.typ != walWrite {
+			continue
+		}
+		file, ok := files[rec.file]
+		if !ok {
+			var err error
+			file, err = os.OpenFile(walFiles[rec.file], os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			files[rec.file] = file
+		}
+		if _, err := file.WriteAt(rec.data, rec.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the keys in order for the bulk loader,
+// the last value of a key wins like with separate updates.
+func walLoadKeys(loads []walRecord) func() ([]byte, []byte, bool) {
+	slices.SortStableFunc(loads, func(a, b walRecord) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	i := 0
+	return func() ([]byte, []byte, bool) {
+		for ; i < len(loads); i++ {
+			if i+1 < len(loads) && bytes.Equal(loads[i].key, loads[i+1].key) {
+				continue // replaced
+			}
+			i++
+			return loads[i-1].key, loads[i-1].data, true
+		}
+		return nil, nil, false
+	}
+}
+
+// the size of a data file including the appends of the current statement
+func (w *WAL) fileSize(filename string) (int64, error) {
+	size := int64(0)
+	fi, err := os.Stat(filename)
+	if err == nil {
+		size = fi.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return size + w.pending[filename], nil
+}
+
+func (w *WAL) writeAt(filename string, offset int64, data []byte) {
+	w.batch = append(w.batch, walRecord{
+		typ: walWrite, file: walFileID(filename), offset: offset, data: data,
+	})
+}
+
+// returns the offset of the appended data
+func (w *WAL) append(filename string, data []byte) (int64, error) {
+	offset, err := w.fileSize(filename)
+	if err != nil {
+		return 0, err
+	}
+	w.writeAt(filename, offset, data)
+	w.pending[filename] += int64(len(data))
+	return offset, nil
+}
+
+func (w *WAL) setIndex(tree string, key []byte, val []byte) {
+	w.batch = append(w.batch, walRecord{typ: walTreeIndex, tree: tree, key: key, data: val})
+}
+
+// keys are added to the tree by the bulk loader, for many keys at once
+func (w *WAL) loadIndex(tree string, key []byte, val []byte) {
+	w.batch = append(w.batch, walRecord{typ: walTreeLoad, tree: tree, key: key, data: val})
+}
+
+// drop the current statement, nothing of it was logged
+func (w *WAL) abort() {
+	w.batch = nil
+	w.pending = map[string]int64{}
+}
+
+// check the current statement, log it, then apply it
+func (w *WAL) commit(pool *Pool) error {
+	if w.failed != nil {
+		w.abort()
+		return w.failed
+	}
+	if len(w.batch) == 0 {
+		return nil
+	}
+	batch := w.batch
+	w.batch = nil
+	w.pending = map[string]int64{}
+	if err := walCheck(batch, pool); err != nil {
+		return err
+	}
+
+	buf := []byte{}
+	for _, rec := range batch {
+		buf = walEncode(buf, rec)
+	}
+	buf = walEncode(buf, walRecord{typ: walCommit})
+	if _, err := w.fp.WriteAt(buf, w.size); err != nil {
+		return w.drop(fmt.Errorf("write WAL: %w", err))
+	}
+	// the statement is committed once the log is on disk
+	if err := w.fp.Sync(); err != nil {
+		return w.drop(fmt.Errorf("fsync WAL: %w", err))
+	}
+
+	if err := walApplyIndex(batch, pool); errors.Is(err, tree.ErrFailed) {
+		// the master page may or may not have the statement,
+		// the replay finishes it on the next start.
+		w.size += int64(len(buf))
+		w.failed = fmt.Errorf("reopen the database to recover: %w", err)
+		return w.failed
+	} else if err != nil {
+		// nothing is applied, the statement must not be replayed
+		return w.drop(err)
+	}
+	w.size += int64(len(buf))
+	if err := walApplyFiles(batch); err != nil {
+		// the index has the statement, the replay finishes it on the
+		// next start. the appends of later statements would go to the
+		// wrong offsets until then.
+		w.failed = fmt.Errorf("reopen the database to recover: %w", err)
+		return w.failed
+	}
+	if w.size >= WalCheckpointSize {
+		return w.checkpoint()
+	}
+	return nil
+}
+
+// remove the statement past the end of the log
+func (w *WAL) drop(err error) error {
+	if terr := w.fp.Truncate(w.size); terr != nil {
+		w.failed = fmt.Errorf("truncate WAL: %w", terr)
+		return errors.Join(err, w.failed)
+	}
+	if serr := w.fp.Sync(); serr != nil {
+		w.failed = fmt.Errorf("fsync WAL: %w", serr)
+		return errors.Join(err, w.failed)
+	}
+	return err
+}
+
+// make the data files durable so the log can be emptied.
+// the index file is synced by its own commits.
+func (w *WAL) checkpoint() error {
+	for _, name := range walFiles {
+		file, err := os.OpenFile(name, os.O_RDWR, 0644)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("fsync %s: %w", name, err)
+		}
+	}
+
+	if err := w.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if err := w.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	w.size = 0
+	return nil
+}
+
+// the log is kept for the replay after a failure
+func (w *WAL) Close() error {
+	err := w.failed
+	if err == nil {
+		err = w.checkpoint()
+	}
+	w.fp.Close()
+	return err
+}
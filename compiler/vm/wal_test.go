@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	tree "github.com/aidanjjenkins/bplustree"
+	c "github.com/aidanjjenkins/compiler/compile"
+)
+
+func compileStatement(t *testing.T, input string) *c.Bytecode {
+	program := createParseProgram(input, t)
+	comp := c.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatal("Compile error: ", err)
+	}
+	return comp.Bytecode()
+}
+
+func runStatement(t *testing.T, input string) *VM {
+	machine := New(compileStatement(t, input))
+	err := machine.Run()
+	if err != nil {
+		t.Fatal("Error running: ", err)
+	}
+	return machine
+}
+
+// close the files without a checkpoint, which releases the locks
+func crash(machine *VM) {
+	machine.wal.fp.Close()
+	machine.Pool.Close()
+}
+
+func removeDataFiles() {
+	os.Remove(IdxFile)
+	os.Remove(RowsFile)
+	os.Remove(TableFile)
+	os.Remove(WalFile)
+}
+
+func checkRecovered(t *testing.T, machine *VM) {
+	offset, ok, _ := machine.Pool.Search("dogs")
+	if !ok {
+		t.Fatalf("table not recovered")
+	}
+	row, err := readRow(int64(offset), TableFile)
+	if err != nil {
+		t.Fatalf("readRow: %v", err)
+	}
+	if count := DecodeTableCount(row); count != 2 {
+		t.Fatalf("expected 2 rows, got %d", count)
+	}
+
+	lastRow, err := getLastRow(RowsFile)
+	if err != nil {
+		t.Fatalf("getLastRow: %v", err)
+	}
+	if lastRow[0] != "dogs" || lastRow[1] != "stella" {
+		t.Fatalf("unexpected last row: %v", lastRow)
+	}
+	fi, err := os.Stat(WalFile)
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("expected an empty WAL after recovery: %v", err)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	machine := runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");")
+	crash(machine)
+	log, err := os.ReadFile(WalFile)
+	if err != nil || len(log) == 0 {
+		t.Fatalf("expected a WAL: %v", err)
+	}
+
+	// a crash before the writes reached the disk
+	os.Remove(IdxFile)
+	os.Remove(RowsFile)
+	os.Remove(TableFile)
+	// and a statement that was not committed
+	torn := walEncode(nil, walRecord{
+		typ: walWrite, file: walFileID(RowsFile), offset: 0, data: []byte("garbage"),
+	})
+	torn = walEncode(torn, walRecord{typ: walCommit})
+	torn = torn[:len(torn)-1]
+	if err := os.WriteFile(WalFile, append(log, torn...), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkRecovered(t, machine)
+}
+
+func TestWALReplayIsIdempotent(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	machine := runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"INSERT INTO dogs VALUES (\"stella\", \"mutt\");")
+	crash(machine)
+
+	// a crash after the writes were applied, they are applied again
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkRecovered(t, machine)
+}
+
+// a second VM on the same files fails until the first one is closed
+func TestLocked(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	machine := New(&c.Bytecode{})
+	other := New(&c.Bytecode{})
+	if err := other.Run(); !errors.Is(err, tree.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	other.Close()
+	machine.Close()
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run after Close: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	// nothing to open, nothing is created
+	machine := NewReadOnly(&c.Bytecode{})
+	if err := machine.Run(); err == nil {
+		t.Fatalf("opened a missing index")
+	}
+	machine.Close()
+	if _, err := os.Stat(IdxFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the index was created: %v", err)
+	}
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\");").Close()
+	before, _ := os.ReadFile(RowsFile)
+
+	machine = NewReadOnly(compileStatement(t, "SELECT * FROM dogs WHERE name = \"winnie\";"))
+	if err := machine.Run(); err != nil {
+		t.Fatalf("SELECT: %v", err)
+	}
+	machine.Close()
+	machine = NewReadOnly(compileStatement(t, "INSERT INTO dogs VALUES (\"stella\", \"mutt\");"))
+	if err := machine.Run(); !errors.Is(err, tree.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	machine.Close()
+	if after, _ := os.ReadFile(RowsFile); !bytes.Equal(before, after) {
+		t.Fatalf("the rows were modified")
+	}
+
+	// the log of a crashed writer must be replayed first
+	crash(runStatement(t, "INSERT INTO dogs VALUES (\"stella\", \"mutt\");"))
+	machine = NewReadOnly(&c.Bytecode{})
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, ErrRecoveryNeeded) {
+		t.Fatalf("expected ErrRecoveryNeeded, got %v", err)
+	}
+}
+
+// the bulk loaded keys of a statement are sorted, the last value wins
+func TestWALLoadIndex(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	machine := New(&c.Bytecode{})
+	machine.wal.setIndex("t", []byte("b"), []byte("set"))
+	for i, key := range []string{"c", "a", "b", "c"} {
+		machine.wal.loadIndex("t", []byte(key), []byte{byte('0' + i)})
+	}
+	machine.wal.loadIndex("u", []byte("a"), []byte("u"))
+	// written by older versions
+	machine.wal.batch = append(machine.wal.batch, walRecord{typ: walLoad, key: []byte("old"), data: []byte("1")})
+	if err := machine.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	crash(machine)
+
+	// and the same after a replay
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for key, val := range expected {
+		if got, _, _ := machine.Pool.db.Tree("t").Get([]byte(key)); string(got) != val {
+			t.Fatalf("%s: got %q, expected %q", key, got, val)
+		}
+	}
+	if got, _, _ := machine.Pool.db.Tree("u").Get([]byte("a")); string(got) != "u" {
+		t.Fatalf("a: got %q in the other tree", got)
+	}
+	if got, _, _ := machine.Pool.db.Get("old"); string(got) != "1" {
+		t.Fatalf("old: got %q", got)
+	}
+	if errs := machine.Pool.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+// the changes queued before a statement fails are dropped, not committed
+func TestWALFailedStatement(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\");").Close()
+	rows, _ := os.ReadFile(RowsFile)
+	tables, _ := os.ReadFile(TableFile)
+
+	machine := New(compileStatement(t, "CREATE INDEX ON dogs (color);"))
+	defer machine.Close()
+	if _, err := machine.wal.append(RowsFile, []byte("orphan")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := machine.Run(); err == nil {
+		t.Fatalf("expected an error for a missing column")
+	}
+	if err := machine.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if after, _ := os.ReadFile(RowsFile); !bytes.Equal(rows, after) {
+		t.Fatalf("the rows were modified")
+	}
+	if after, _ := os.ReadFile(TableFile); !bytes.Equal(tables, after) {
+		t.Fatalf("the tables were modified")
+	}
+}
+
+var errInjected = errors.New("injected fault")
+
+// an index store whose master page writes fail once armed
+type masterFaultStore struct {
+	tree.PageStore
+	fail bool
+}
+
+func (s *masterFaultStore) WriteMaster(offset int, data []byte) error {
+	if s.fail {
+		return errInjected
+	}
+	return s.PageStore.WriteMaster(offset, data)
+}
+
+// the pages of the statement are written but the master page isn't,
+// so the statement stays in the log for the replay
+func TestWALMasterFailed(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar); "+
+		"INSERT INTO dogs VALUES (\"winnie\", \"cane corso\"); "+
+		"CREATE INDEX ON dogs (breed);").Close()
+
+	machine := New(compileStatement(t, "INSERT INTO dogs VALUES (\"stella\", \"great dane\");"))
+	machine.Pool.Close()
+	store := &masterFaultStore{PageStore: &tree.FileStore{Path: IdxFile}}
+	pool := &Pool{}
+	pool.db.Store = store
+	if err := pool.db.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	machine.Pool = pool
+	store.fail = true
+	if err := machine.Run(); !errors.Is(err, tree.ErrFailed) {
+		t.Fatalf("expected ErrFailed, got %v", err)
+	}
+	if err := machine.Close(); !errors.Is(err, tree.ErrFailed) {
+		t.Fatalf("Close: expected ErrFailed, got %v", err)
+	}
+	if fi, err := os.Stat(WalFile); err != nil || fi.Size() == 0 {
+		t.Fatalf("the statement was dropped from the WAL: %v", err)
+	}
+
+	machine = New(&c.Bytecode{})
+	defer machine.Close()
+	checkRecovered(t, machine)
+	if offsets, err := machine.Pool.Lookup("dogs", []string{"breed"}, []string{"great dane"}); err != nil || len(offsets) != 1 {
+		t.Fatalf("Lookup: %v (%v)", offsets, err)
+	}
+	if errs := machine.Pool.Verify(); len(errs) != 0 {
+		t.Fatalf("Verify: %v", errs)
+	}
+}
+
+// a statement that can't be applied is rejected before it's logged
+func TestWALCheck(t *testing.T) {
+	removeDataFiles()
+	defer removeDataFiles()
+
+	runStatement(t, "CREATE TABLE dogs (name varchar, breed varchar);").Close()
+	machine := New(&c.Bytecode{})
+	if _, err := machine.wal.append(RowsFile, []byte("row")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	machine.wal.setIndex("t", bytes.Repeat([]byte("k"), tree.BTREE_MAX_KEY_SIZE+1), nil)
+	if err := machine.commit(); !errors.Is(err, tree.ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	machine.wal.setIndex(string(bytes.Repeat([]byte("t"), 300)), []byte("k"), nil)
+	if err := machine.commit(); !errors.Is(err, tree.ErrBadTreeName) {
+		t.Fatalf("expected ErrBadTreeName, got %v", err)
+	}
+	if fi, err := os.Stat(WalFile); err != nil || fi.Size() != 0 {
+		t.Fatalf("the statements were logged: %v", err)
+	}
+	if _, err := os.Stat(RowsFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the row was written: %v", err)
+	}
+	crash(machine)
+
+	// and fail the replay if an older version logged them
+	bad := walEncode(nil, walRecord{typ: walWrite, file: walFileID(RowsFile), data: []byte("row")})
+	bad = walEncode(bad, walRecord{typ: walTreeIndex, tree: "t", key: bytes.Repeat([]byte("k"), tree.BTREE_MAX_KEY_SIZE+1)})
+	bad = walEncode(bad, walRecord{typ: walCommit})
+	if err := os.WriteFile(WalFile, bad, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	machine = New(compileStatement(t, "INSERT INTO dogs VALUES (\"winnie\", \"cane corso\");"))
+	err := machine.Run()
+	machine.Close()
+	if !errors.Is(err, tree.ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if data, err := os.ReadFile(WalFile); err != nil || !bytes.Equal(data, bad) {
+		t.Fatalf("the WAL was not kept: %v", err)
+	}
+	if _, err := os.Stat(RowsFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the row was written: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/aidanjjenkins/compiler/repl"
 	"os"
@@ -24,7 +25,13 @@ func main() {
 	// if err != nil {
 	// 	panic(err)
 	// }
+	readOnly := flag.Bool("readonly", false, "open the database without write access")
+	flag.Parse()
+
 	fmt.Println("RusoDB started!")
+	if *readOnly {
+		fmt.Println("Read-only mode, statements that write are rejected")
+	}
 	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	repl.Start(os.Stdin, os.Stdout, *readOnly)
 }